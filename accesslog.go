@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requestIDHeader carries the request ID in both directions. A client may
+// choose the ID, otherwise one is generated.
+const requestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// structuredLog writes one JSON object per line, without the timestamp
+// prefix of the standard logger.
+var structuredLog = log.New(os.Stderr, "", 0)
+
+var (
+	requestIDPrefix  = newRequestIDPrefix()
+	requestIDCounter uint64
+)
+
+func newRequestIDPrefix() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+func nextRequestID() string {
+	n := atomic.AddUint64(&requestIDCounter, 1)
+	return requestIDPrefix + "-" + strconv.FormatUint(n, 10)
+}
+
+// requestID returns the ID assigned to r by requestIDMiddleware.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDMiddleware assigns every request an ID and echoes it in the
+// response, so a client can quote it when reporting a problem.
+func (a *api) requestIDMiddleware(rt route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = nextRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Level      string  `json:"level"`
+	RequestID  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	Route      string  `json:"route"`
+	EntityID   string  `json:"entity_id,omitempty"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	Slow       bool    `json:"slow,omitempty"`
+}
+
+// entityID returns the path variable that identifies the entity of a
+// request, if the route has one.
+func entityID(r *http.Request) string {
+	vars := mux.Vars(r)
+	for _, name := range []string{"id", "userID", "locationID"} {
+		if id, ok := vars[name]; ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// accessLogMiddleware logs a sample of the requests, and every request that
+// is slow or fails with a server error.
+func (a *api) accessLogMiddleware(rt route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		elapsed := time.Since(start)
+
+		status := sw.statusCode()
+		threshold := time.Duration(a.config.AccessLog.SlowThreshold)
+		slow := threshold > 0 && elapsed >= threshold
+		sampled := a.config.AccessLog.SampleRate > 0 && mathrand.Float64() < a.config.AccessLog.SampleRate
+		if !slow && !sampled && status < 500 {
+			return
+		}
+
+		level := "info"
+		if slow {
+			level = "warn"
+		}
+		if status >= 500 {
+			level = "error"
+		}
+		writeStructured(accessLogEntry{
+			Time:       start.UTC().Format(time.RFC3339Nano),
+			Level:      level,
+			RequestID:  requestID(r),
+			Method:     r.Method,
+			Route:      rt.template,
+			EntityID:   entityID(r),
+			Status:     status,
+			Bytes:      sw.bytes,
+			DurationMS: float64(elapsed) / float64(time.Millisecond),
+			Slow:       slow,
+		})
+	})
+}
+
+type errorLogEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	RequestID string `json:"request_id,omitempty"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Message   string `json:"message"`
+}
+
+// logRequestError logs an error that happened while serving r, tagged with
+// the request ID so it can be matched with the access log.
+func logRequestError(r *http.Request, msg string, err error) {
+	logRequest(r, "error", msg, err)
+}
+
+// logClientError logs a request that is answered with a 4xx because of what
+// the client sent. That is no fault of the server, so it is only logged at
+// info level.
+func logClientError(r *http.Request, msg string, err error) {
+	logRequest(r, "info", msg, err)
+}
+
+func logRequest(r *http.Request, level string, msg string, err error) {
+	if err != nil {
+		msg += ": " + err.Error()
+	}
+	writeStructured(errorLogEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     level,
+		RequestID: requestID(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Message:   msg,
+	})
+}
+
+func writeStructured(entry interface{}) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	structuredLog.Println(string(b))
+}
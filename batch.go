@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Batch modes, selected with the mode query parameter.
+const (
+	// batchAtomic applies every item or none of them.
+	batchAtomic = "atomic"
+	// batchPartial applies the valid items and reports the others.
+	batchPartial = "partial"
+)
+
+// batchItemResult is the outcome of one item of a batch. Status is
+// "created", "failed", or "skipped" for valid items of a failed atomic
+// batch.
+type batchItemResult struct {
+	Index  int            `json:"index"`
+	ID     *int32         `json:"id,omitempty"`
+	Status string         `json:"status"`
+	Error  *errorEnvelope `json:"error,omitempty"`
+}
+
+// batchResponse is the response type of POST /{entity}/batch
+type batchResponse struct {
+	Mode    string            `json:"mode"`
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Results []batchItemResult `json:"results"`
+}
+
+// batchAdd stores the items at the given indices, atomically or not, and
+// returns their errors in the same order and whether anything was stored.
+type batchAdd func(indices []int, atomic bool) ([]error, bool)
+
+func parseBatchMode(r *http.Request) (string, error) {
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", batchAtomic:
+		return batchAtomic, nil
+	case batchPartial:
+		return batchPartial, nil
+	default:
+		return "", errInvalidField("mode", "must be atomic or partial")
+	}
+}
+
+// checkBatchSize fails a batch of n items that is larger than the limit.
+func (a *api) checkBatchSize(n int) error {
+	if n > a.config.BatchLimit {
+		return &apiError{
+			status:  http.StatusRequestEntityTooLarge,
+			code:    "batch_too_large",
+			message: fmt.Sprintf("a batch may hold at most %d items", a.config.BatchLimit),
+		}
+	}
+	return nil
+}
+
+func errNullItem() *apiError {
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "invalid_item",
+		message: "item must be an object",
+	}
+}
+
+// runBatch applies the items that passed validation, errs holding the
+// validation error of each item, and writes the per-item results. A failed
+// atomic batch answers with the status of its first error.
+func (a *api) runBatch(w http.ResponseWriter, r *http.Request, mode string, ids []*int32, errs []error, add batchAdd) {
+	valid := make([]int, 0, len(errs))
+	for i, err := range errs {
+		if err == nil {
+			valid = append(valid, i)
+		}
+	}
+
+	atomic := mode == batchAtomic
+	applied := false
+	if !atomic || len(valid) == len(errs) {
+		var addErrs []error
+		addErrs, applied = add(valid, atomic)
+		for j, i := range valid {
+			errs[i] = addErrs[j]
+		}
+	}
+
+	response := batchResponse{
+		Mode:    mode,
+		Results: make([]batchItemResult, len(errs)),
+	}
+	status := http.StatusOK
+	for i, err := range errs {
+		result := batchItemResult{Index: i, ID: ids[i]}
+		switch {
+		case err != nil:
+			apiErr, ok := err.(*apiError)
+			if !ok {
+				logRequestError(r, "batch item", err)
+				apiErr = errInternal
+			}
+			if atomic && status == http.StatusOK {
+				status = apiErr.status
+			}
+			result.Status = "failed"
+			envelope := apiErr.envelope()
+			result.Error = &envelope
+			response.Failed++
+		case applied:
+			result.Status = "created"
+			response.Created++
+		default:
+			result.Status = "skipped"
+		}
+		response.Results[i] = result
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logRequestError(r, "encode response", err)
+	}
+}
+
+func (a *api) batchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	mode, err := parseBatchMode(r)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	var batch struct {
+		Users []*NewUser `json:"users"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&batch)
+	if err != nil {
+		a.writeError(w, r, errInvalidBody(err))
+		return
+	}
+	if err := a.checkBatchSize(len(batch.Users)); err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+
+	ids := make([]*int32, len(batch.Users))
+	errs := make([]error, len(batch.Users))
+	for i, newUser := range batch.Users {
+		if newUser == nil {
+			errs[i] = errNullItem()
+			continue
+		}
+		ids[i] = newUser.ID
+		errs[i] = newUser.validate()
+	}
+
+	a.runBatch(w, r, mode, ids, errs, func(indices []int, atomic bool) ([]error, bool) {
+		users := make([]*User, len(indices))
+		for j, i := range indices {
+			users[j] = batch.Users[i].user()
+		}
+		if atomic {
+			return currentDB().addUsersAtomic(users)
+		}
+		return currentDB().addUsers(users), true
+	})
+}
+
+func (a *api) batchLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	mode, err := parseBatchMode(r)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	var batch struct {
+		Locations []*NewLocation `json:"locations"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&batch)
+	if err != nil {
+		a.writeError(w, r, errInvalidBody(err))
+		return
+	}
+	if err := a.checkBatchSize(len(batch.Locations)); err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+
+	ids := make([]*int32, len(batch.Locations))
+	errs := make([]error, len(batch.Locations))
+	for i, newLocation := range batch.Locations {
+		if newLocation == nil {
+			errs[i] = errNullItem()
+			continue
+		}
+		ids[i] = newLocation.ID
+		errs[i] = newLocation.validate()
+	}
+
+	a.runBatch(w, r, mode, ids, errs, func(indices []int, atomic bool) ([]error, bool) {
+		locations := make([]*Location, len(indices))
+		for j, i := range indices {
+			locations[j] = batch.Locations[i].location()
+		}
+		if atomic {
+			return currentDB().addLocationsAtomic(locations)
+		}
+		return currentDB().addLocations(locations), true
+	})
+}
+
+func (a *api) batchVisitsHandler(w http.ResponseWriter, r *http.Request) {
+	mode, err := parseBatchMode(r)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	var batch struct {
+		Visits []*NewVisit `json:"visits"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&batch)
+	if err != nil {
+		a.writeError(w, r, errInvalidBody(err))
+		return
+	}
+	if err := a.checkBatchSize(len(batch.Visits)); err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+
+	ids := make([]*int32, len(batch.Visits))
+	errs := make([]error, len(batch.Visits))
+	for i, newVisit := range batch.Visits {
+		if newVisit == nil {
+			errs[i] = errNullItem()
+			continue
+		}
+		ids[i] = newVisit.ID
+		errs[i] = newVisit.validate()
+	}
+
+	a.runBatch(w, r, mode, ids, errs, func(indices []int, atomic bool) ([]error, bool) {
+		visits := make([]*Visit, len(indices))
+		for j, i := range indices {
+			visits[j] = batch.Visits[i].visit()
+		}
+		if atomic {
+			return currentDB().addVisitsAtomic(visits)
+		}
+		return currentDB().addVisits(visits), true
+	})
+}
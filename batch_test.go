@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// postBatch sends body to the batch endpoint of entity and decodes the
+// per-item results.
+func postBatch(t *testing.T, h http.Handler, entity string, mode string, body string) (int, batchResponse) {
+	t.Helper()
+	target := "/" + entity + "/batch"
+	if mode != "" {
+		target += "?mode=" + mode
+	}
+	rec := serve(h, "POST", target, body)
+	var response batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s: %v: %s", target, err, rec.Body)
+	}
+	return rec.Code, response
+}
+
+// batchStatuses returns the status of every item, with the error code of
+// the failed ones.
+func batchStatuses(response batchResponse) []string {
+	statuses := make([]string, len(response.Results))
+	for i, result := range response.Results {
+		statuses[i] = result.Status
+		if result.Error != nil {
+			statuses[i] += ":" + result.Error.Code
+		}
+	}
+	return statuses
+}
+
+func newVisitJSON(id int, user int, location int) string {
+	return fmt.Sprintf(`{"id":%d,"user":%d,"location":%d,"visited_at":1000,"mark":3}`, id, user, location)
+}
+
+func TestBatchAtomicRollback(t *testing.T) {
+	db := newTestDB(t, 10, 10, 10)
+	router := newTestAPI(t, db).newRouter()
+
+	tests := []struct {
+		name  string
+		items []string
+		want  int
+	}{
+		{"taken id", []string{newVisitJSON(11, 1, 1), newVisitJSON(12, 2, 2), newVisitJSON(5, 3, 3)}, http.StatusConflict},
+		{"repeated id", []string{newVisitJSON(11, 1, 1), newVisitJSON(12, 2, 2), newVisitJSON(11, 3, 3)}, http.StatusConflict},
+		{"invalid item", []string{newVisitJSON(11, 1, 1), `{"id":12,"user":2}`, newVisitJSON(13, 3, 3)}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		status, response := postBatch(t, router, "visits", "", `{"visits":[`+strings.Join(tt.items, ",")+`]}`)
+		if status != tt.want || response.Mode != batchAtomic || response.Created != 0 || response.Failed != 1 {
+			t.Errorf("%s: %d %+v, want %d with one failed item", tt.name, status, response, tt.want)
+		}
+		for _, result := range response.Results {
+			if result.Status == "created" {
+				t.Errorf("%s: item %d created", tt.name, result.Index)
+			}
+		}
+		for _, id := range []int32{11, 12, 13} {
+			if db.getVisit(id) != nil {
+				t.Errorf("%s: visit %d stored", tt.name, id)
+			}
+		}
+	}
+	if visit := db.getVisit(5); visit.User != 1+5%10 {
+		t.Errorf("visit 5 changed: %+v", visit)
+	}
+	checkVisitIndexes(t, db)
+}
+
+func TestBatchPartial(t *testing.T) {
+	db := newTestDB(t, 10, 10, 10)
+	router := newTestAPI(t, db).newRouter()
+
+	items := []string{
+		newVisitJSON(11, 1, 1),
+		newVisitJSON(5, 2, 2),
+		`{"id":12,"user":2}`,
+		`null`,
+		newVisitJSON(13, 3, 3),
+		newVisitJSON(13, 4, 4),
+	}
+	status, response := postBatch(t, router, "visits", batchPartial, `{"visits":[`+strings.Join(items, ",")+`]}`)
+	if status != http.StatusOK || response.Created != 2 || response.Failed != 4 {
+		t.Fatalf("%d, %d created, %d failed; want 200, 2 created, 4 failed", status, response.Created, response.Failed)
+	}
+	want := []string{"created", "failed:conflict", "failed:missing_field", "failed:invalid_item", "created", "failed:conflict"}
+	if got := batchStatuses(response); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("statuses %v, want %v", got, want)
+	}
+	for i, result := range response.Results {
+		if result.Index != i {
+			t.Errorf("result %d has index %d", i, result.Index)
+		}
+	}
+	if visit := db.getVisit(11); visit == nil || visit.User != 1 {
+		t.Errorf("visit 11: %+v", visit)
+	}
+	if visit := db.getVisit(13); visit == nil || visit.User != 3 {
+		t.Errorf("visit 13: %+v, want the first item with its ID", visit)
+	}
+	if db.getVisit(12) != nil {
+		t.Error("invalid visit 12 stored")
+	}
+	checkVisitIndexes(t, db)
+}
+
+func TestBatchSizeLimit(t *testing.T) {
+	db := newTestDB(t, 10, 10, 10)
+	a := newTestAPI(t, db)
+	a.config.BatchLimit = 2
+	router := a.newRouter()
+
+	items := []string{
+		`{"id":11,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`,
+		`{"id":12,"email":"d@e.f","first_name":"D","last_name":"E","gender":"f","birth_date":0}`,
+		`{"id":13,"email":"g@h.i","first_name":"G","last_name":"H","gender":"m","birth_date":0}`,
+	}
+	body := `{"users":[` + strings.Join(items, ",") + `]}`
+	for _, mode := range []string{batchAtomic, batchPartial} {
+		rec := serve(router, "POST", "/users/batch?mode="+mode, body)
+		if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), `"batch_too_large"`) {
+			t.Errorf("%s batch over the limit: %d %s", mode, rec.Code, rec.Body)
+		}
+	}
+	if db.getUser(11) != nil {
+		t.Error("a batch over the limit was applied")
+	}
+
+	status, response := postBatch(t, router, "users", "", `{"users":[`+strings.Join(items[:2], ",")+`]}`)
+	if status != http.StatusOK || response.Created != 2 {
+		t.Errorf("batch at the limit: %d %+v", status, response)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the runtime configuration of the server. Values are taken from
+// the defaults, then the config file, then HICUP_* environment variables and
+// finally the command line flags, each overriding the previous ones.
+type Config struct {
+	Listen          string          `json:"listen" yaml:"listen"`
+	DataDir         string          `json:"data_dir" yaml:"data_dir"`
+	LoadPolicy      string          `json:"load_policy" yaml:"load_policy"`
+	Engine          string          `json:"engine" yaml:"engine"`
+	ShutdownTimeout Duration        `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	ContestErrors   bool            `json:"contest_errors" yaml:"contest_errors"`
+	BTreeDegree     int             `json:"btree_degree" yaml:"btree_degree"`
+	AgeReference    time.Time       `json:"age_reference" yaml:"age_reference"`
+	AverageDigits   int             `json:"average_digits" yaml:"average_digits"`
+	HistoryLimit    int             `json:"history_limit" yaml:"history_limit"`
+	HistoryEntities int             `json:"history_entities" yaml:"history_entities"`
+	EventBuffer     int             `json:"event_buffer" yaml:"event_buffer"`
+	IdempotencyTTL  Duration        `json:"idempotency_ttl" yaml:"idempotency_ttl"`
+	IdempotencyKeys int             `json:"idempotency_keys" yaml:"idempotency_keys"`
+	BatchLimit      int             `json:"batch_limit" yaml:"batch_limit"`
+	AccessLog       AccessLogConfig `json:"access_log" yaml:"access_log"`
+	Admin           AdminConfig     `json:"admin" yaml:"admin"`
+	Warmup          WarmupConfig    `json:"warmup" yaml:"warmup"`
+	Webhooks        WebhooksConfig  `json:"webhooks" yaml:"webhooks"`
+}
+
+// AccessLogConfig controls which requests are written to the access log.
+type AccessLogConfig struct {
+	// SampleRate is the fraction of requests that are logged, in [0, 1].
+	SampleRate float64 `json:"sample_rate" yaml:"sample_rate"`
+	// SlowThreshold makes every request that takes at least this long to
+	// be logged regardless of sampling. Zero disables it.
+	SlowThreshold Duration `json:"slow_threshold" yaml:"slow_threshold"`
+}
+
+// AdminConfig guards the /admin endpoints.
+type AdminConfig struct {
+	// Token must be sent as "Authorization: Bearer <token>" on the admin
+	// endpoints. They are disabled while it is empty. It cannot be set on
+	// the command line, where it would show in the process list.
+	Token string `json:"token" yaml:"token"`
+	// Root is the directory that reload paths are resolved in and confined
+	// to. Empty means the data directory, or the directory of the data
+	// file.
+	Root string `json:"root" yaml:"root"`
+	// ReloadJournal bounds the writes that are kept during a reload to
+	// be replayed onto the new data. A reload that sees more fails and
+	// leaves the live data in place.
+	ReloadJournal int `json:"reload_journal" yaml:"reload_journal"`
+}
+
+// adminRoot returns the directory that admin reload paths are confined to.
+func (c *Config) adminRoot() string {
+	if c.Admin.Root != "" {
+		return c.Admin.Root
+	}
+	if info, err := os.Stat(c.DataDir); err == nil && info.IsDir() {
+		return c.DataDir
+	}
+	return filepath.Dir(c.DataDir)
+}
+
+// WarmupConfig controls the stage between the startup load and readiness.
+type WarmupConfig struct {
+	// Enabled runs the warm-up at all.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Ammo is a test_data.zip whose phase 1 requests are replayed against
+	// the handlers. Empty skips the replay.
+	Ammo string `json:"ammo" yaml:"ammo"`
+}
+
+// WebhooksConfig controls the delivery of change events to webhooks. The
+// targets can only be set in the config file.
+type WebhooksConfig struct {
+	Targets []WebhookTarget `json:"targets" yaml:"targets"`
+	// QueueSize bounds the deliveries that are queued, being sent or
+	// waiting for a retry. Events that find it full go to the dead-letter
+	// file.
+	QueueSize int `json:"queue_size" yaml:"queue_size"`
+	// MaxAttempts is how often a delivery is tried before it goes to the
+	// dead-letter file.
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+	// InitialBackoff is the wait before the first retry. It doubles with
+	// every retry up to MaxBackoff.
+	InitialBackoff Duration `json:"initial_backoff" yaml:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff" yaml:"max_backoff"`
+	Timeout        Duration `json:"timeout" yaml:"timeout"`
+	// DeadLetter is the file undelivered events are appended to, one JSON
+	// object per line.
+	DeadLetter string `json:"dead_letter" yaml:"dead_letter"`
+}
+
+// WebhookTarget is an endpoint that receives change events.
+type WebhookTarget struct {
+	URL string `json:"url" yaml:"url"`
+	// Entities limits the events to users, locations or visits. Empty
+	// sends all of them.
+	Entities []string `json:"entities" yaml:"entities"`
+	// Secret signs the body with HMAC-SHA256 if set.
+	Secret string `json:"secret" yaml:"secret"`
+}
+
+// Duration is a time.Duration written as "1.5s" in config files.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+func (d *Duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// defaultAgeReference is the moment ages are computed at. It seems it is
+// when the contest data was generated.
+// Commit time https://github.com/MailRuChamps/hlcupdocs/commit/5dd3cd07200ae97a5badd242bf891aad3fed6e5b
+var defaultAgeReference = time.Date(2018, 12, 15, 20, 33, 0, 0, time.UTC)
+
+func defaultConfig() Config {
+	return Config{
+		Listen:          ":8080",
+		DataDir:         "./data/",
+		LoadPolicy:      loadFirstWins,
+		Engine:          "http",
+		ShutdownTimeout: Duration(10 * time.Second),
+		BTreeDegree:     BTreeDegree,
+		AgeReference:    defaultAgeReference,
+		AverageDigits:   5,
+		HistoryLimit:    16,
+		HistoryEntities: 100000,
+		EventBuffer:     4096,
+		IdempotencyTTL:  Duration(24 * time.Hour),
+		IdempotencyKeys: 100000,
+		BatchLimit:      10000,
+		Admin: AdminConfig{
+			ReloadJournal: 100000,
+		},
+		Warmup: WarmupConfig{
+			Enabled: true,
+		},
+		Webhooks: WebhooksConfig{
+			QueueSize:      1024,
+			MaxAttempts:    5,
+			InitialBackoff: Duration(500 * time.Millisecond),
+			MaxBackoff:     Duration(30 * time.Second),
+			Timeout:        Duration(5 * time.Second),
+			DeadLetter:     "webhook-dead-letters.ndjson",
+		},
+	}
+}
+
+// validate reports the first setting that cannot work.
+func (c *Config) validate() error {
+	switch {
+	case c.Listen == "":
+		return errors.New("listen must not be empty")
+	case c.DataDir == "":
+		return errors.New("data_dir must not be empty")
+	case c.LoadPolicy != loadFail && c.LoadPolicy != loadFirstWins && c.LoadPolicy != loadLastWins:
+		return fmt.Errorf("load_policy must be fail, first-wins or last-wins, not %q", c.LoadPolicy)
+	case c.Engine != "http" && c.Engine != "raw":
+		return fmt.Errorf("engine must be http or raw, not %q", c.Engine)
+	case c.ShutdownTimeout < 0:
+		return errors.New("shutdown_timeout must not be negative")
+	case c.BTreeDegree < 2:
+		return errors.New("btree_degree must be at least 2")
+	case c.AgeReference.IsZero():
+		return errors.New("age_reference must be set")
+	case c.AverageDigits < 0 || c.AverageDigits > 15:
+		return errors.New("average_digits must be between 0 and 15")
+	case c.HistoryLimit < 0:
+		return errors.New("history_limit must not be negative")
+	case c.HistoryEntities < 1:
+		return errors.New("history_entities must be at least 1")
+	case c.EventBuffer < 1:
+		return errors.New("event_buffer must be at least 1")
+	case c.IdempotencyTTL <= 0:
+		return errors.New("idempotency_ttl must be positive")
+	case c.IdempotencyKeys < 1:
+		return errors.New("idempotency_keys must be at least 1")
+	case c.BatchLimit < 1:
+		return errors.New("batch_limit must be at least 1")
+	case c.Admin.ReloadJournal < 1:
+		return errors.New("admin.reload_journal must be at least 1")
+	case c.AccessLog.SampleRate < 0 || c.AccessLog.SampleRate > 1:
+		return errors.New("access_log.sample_rate must be between 0 and 1")
+	case c.AccessLog.SlowThreshold < 0:
+		return errors.New("access_log.slow_threshold must not be negative")
+	}
+	return c.Webhooks.validate()
+}
+
+func (c *WebhooksConfig) validate() error {
+	switch {
+	case c.QueueSize < 1:
+		return errors.New("webhooks.queue_size must be at least 1")
+	case c.MaxAttempts < 1:
+		return errors.New("webhooks.max_attempts must be at least 1")
+	case c.InitialBackoff <= 0 || c.MaxBackoff < c.InitialBackoff:
+		return errors.New("webhooks.initial_backoff must be positive and at most webhooks.max_backoff")
+	case c.Timeout <= 0:
+		return errors.New("webhooks.timeout must be positive")
+	case len(c.Targets) > 0 && c.DeadLetter == "":
+		return errors.New("webhooks.dead_letter must not be empty")
+	}
+	for i, t := range c.Targets {
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhooks.targets[%d].url must be an http or https URL, not %q", i, t.URL)
+		}
+		for _, entity := range t.Entities {
+			if _, ok := entityColumns[entity]; !ok {
+				return fmt.Errorf("webhooks.targets[%d].entities must list users, locations or visits, not %q", i, entity)
+			}
+		}
+	}
+	return nil
+}
+
+// loadFile overrides c with the settings of a YAML or JSON file. Unknown
+// keys are errors, so a typo does not silently fall back to a default.
+func (c *Config) loadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(c)
+	} else {
+		err = yaml.UnmarshalStrict(b, c)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// loadEnv overrides c with the HICUP_* environment variables that are set.
+func (c *Config) loadEnv() error {
+	vars := []struct {
+		name  string
+		parse func(string) error
+	}{
+		{"HICUP_LISTEN", func(s string) error { c.Listen = s; return nil }},
+		{"HICUP_DATA_DIR", func(s string) error { c.DataDir = s; return nil }},
+		{"HICUP_LOAD_POLICY", func(s string) error { c.LoadPolicy = s; return nil }},
+		{"HICUP_ENGINE", func(s string) error { c.Engine = s; return nil }},
+		{"HICUP_SHUTDOWN_TIMEOUT", c.ShutdownTimeout.set},
+		{"HICUP_CONTEST_ERRORS", func(s string) (err error) {
+			c.ContestErrors, err = strconv.ParseBool(s)
+			return err
+		}},
+		{"HICUP_BTREE_DEGREE", func(s string) (err error) {
+			c.BTreeDegree, err = strconv.Atoi(s)
+			return err
+		}},
+		{"HICUP_AGE_REFERENCE", func(s string) (err error) {
+			c.AgeReference, err = time.Parse(time.RFC3339, s)
+			return err
+		}},
+		{"HICUP_AVERAGE_DIGITS", func(s string) (err error) {
+			c.AverageDigits, err = strconv.Atoi(s)
+			return err
+		}},
+		{"HICUP_HISTORY_LIMIT", func(s string) (err error) {
+			c.HistoryLimit, err = strconv.Atoi(s)
+			return err
+		}},
+		{"HICUP_HISTORY_ENTITIES", func(s string) (err error) {
+			c.HistoryEntities, err = strconv.Atoi(s)
+			return err
+		}},
+		{"HICUP_EVENT_BUFFER", func(s string) (err error) {
+			c.EventBuffer, err = strconv.Atoi(s)
+			return err
+		}},
+		{"HICUP_IDEMPOTENCY_TTL", c.IdempotencyTTL.set},
+		{"HICUP_IDEMPOTENCY_KEYS", func(s string) (err error) {
+			c.IdempotencyKeys, err = strconv.Atoi(s)
+			return err
+		}},
+		{"HICUP_BATCH_LIMIT", func(s string) (err error) {
+			c.BatchLimit, err = strconv.Atoi(s)
+			return err
+		}},
+		{"HICUP_ACCESS_LOG_SAMPLE_RATE", func(s string) (err error) {
+			c.AccessLog.SampleRate, err = strconv.ParseFloat(s, 64)
+			return err
+		}},
+		{"HICUP_ACCESS_LOG_SLOW_THRESHOLD", c.AccessLog.SlowThreshold.set},
+		{"HICUP_ADMIN_TOKEN", func(s string) error { c.Admin.Token = s; return nil }},
+		{"HICUP_ADMIN_ROOT", func(s string) error { c.Admin.Root = s; return nil }},
+		{"HICUP_ADMIN_RELOAD_JOURNAL", func(s string) (err error) {
+			c.Admin.ReloadJournal, err = strconv.Atoi(s)
+			return err
+		}},
+		{"HICUP_WARMUP", func(s string) (err error) {
+			c.Warmup.Enabled, err = strconv.ParseBool(s)
+			return err
+		}},
+		{"HICUP_WARMUP_AMMO", func(s string) error { c.Warmup.Ammo = s; return nil }},
+	}
+	for _, v := range vars {
+		s, ok := os.LookupEnv(v.name)
+		if !ok {
+			continue
+		}
+		if err := v.parse(s); err != nil {
+			return fmt.Errorf("%s: %v", v.name, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig builds the configuration from the command line arguments. It
+// returns whether the effective configuration should only be printed.
+func loadConfig(args []string) (Config, bool, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("HICUP_CONFIG"), "YAML or JSON config file")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	port := fs.Int("port", 8080, "port number (shorthand for -listen :PORT)")
+	listen := fs.String("listen", c.Listen, "listen address")
+	dataDir := fs.String("data", c.DataDir, "data to load at startup: a directory (with data.zip or JSON files), a .zip, a .tar.gz, or - for stdin")
+	loadPolicy := fs.String("load-policy", c.LoadPolicy, "on IDs loaded twice: fail, first-wins or last-wins")
+	engine := fs.String("engine", c.Engine, "server engine: http (net/http + gorilla/mux) or raw")
+	shutdownTimeout := fs.Duration("shutdown-timeout", time.Duration(c.ShutdownTimeout), "how long to wait for requests in flight on SIGTERM")
+	contestErrors := fs.Bool("contest-errors", c.ContestErrors, "reply with the contest's plain text errors instead of JSON")
+	degree := fs.Int("btree-degree", c.BTreeDegree, "degree of the B-trees")
+	averageDigits := fs.Int("average-digits", c.AverageDigits, "decimal digits of /avg responses")
+	historyLimit := fs.Int("history-limit", c.HistoryLimit, "revisions kept per entity for /history and asOf reads (0 disables)")
+	historyEntities := fs.Int("history-entities", c.HistoryEntities, "entities of each kind whose history is kept, least recently written ones are dropped first")
+	eventBuffer := fs.Int("event-buffer", c.EventBuffer, "recent change events kept for /events clients to resume from")
+	idempotencyTTL := fs.Duration("idempotency-ttl", time.Duration(c.IdempotencyTTL), "how long responses are kept for Idempotency-Key replays")
+	idempotencyKeys := fs.Int("idempotency-keys", c.IdempotencyKeys, "Idempotency-Keys remembered at most, the oldest ones are dropped first")
+	batchLimit := fs.Int("batch-limit", c.BatchLimit, "items a /batch request may hold at most")
+	sampleRate := fs.Float64("access-log-sample", c.AccessLog.SampleRate, "fraction of requests written to the access log (0-1)")
+	slowThreshold := fs.Duration("access-log-slow", time.Duration(c.AccessLog.SlowThreshold), "always log requests slower than this (0 disables)")
+	adminRoot := fs.String("admin-root", c.Admin.Root, "directory that /admin/reload paths are confined to (default: the data directory)")
+	reloadJournal := fs.Int("reload-journal", c.Admin.ReloadJournal, "writes kept during a reload to be replayed onto the new data, a reload that sees more fails")
+	warmup := fs.Bool("warmup", c.Warmup.Enabled, "warm up the loaded data before reporting ready")
+	warmupAmmo := fs.String("warmup-ammo", c.Warmup.Ammo, "test_data.zip whose phase 1 is replayed during the warm-up")
+	fs.Parse(args)
+
+	if *configPath != "" {
+		if err := c.loadFile(*configPath); err != nil {
+			return c, false, err
+		}
+	}
+	if err := c.loadEnv(); err != nil {
+		return c, false, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			c.Listen = fmt.Sprintf(":%d", *port)
+		case "listen":
+			c.Listen = *listen
+		case "data":
+			c.DataDir = *dataDir
+		case "load-policy":
+			c.LoadPolicy = *loadPolicy
+		case "engine":
+			c.Engine = *engine
+		case "shutdown-timeout":
+			c.ShutdownTimeout = Duration(*shutdownTimeout)
+		case "contest-errors":
+			c.ContestErrors = *contestErrors
+		case "btree-degree":
+			c.BTreeDegree = *degree
+		case "average-digits":
+			c.AverageDigits = *averageDigits
+		case "history-limit":
+			c.HistoryLimit = *historyLimit
+		case "history-entities":
+			c.HistoryEntities = *historyEntities
+		case "event-buffer":
+			c.EventBuffer = *eventBuffer
+		case "idempotency-ttl":
+			c.IdempotencyTTL = Duration(*idempotencyTTL)
+		case "idempotency-keys":
+			c.IdempotencyKeys = *idempotencyKeys
+		case "batch-limit":
+			c.BatchLimit = *batchLimit
+		case "access-log-sample":
+			c.AccessLog.SampleRate = *sampleRate
+		case "access-log-slow":
+			c.AccessLog.SlowThreshold = Duration(*slowThreshold)
+		case "admin-root":
+			c.Admin.Root = *adminRoot
+		case "reload-journal":
+			c.Admin.ReloadJournal = *reloadJournal
+		case "warmup":
+			c.Warmup.Enabled = *warmup
+		case "warmup-ammo":
+			c.Warmup.Ammo = *warmupAmmo
+		}
+	})
+
+	return c, *printConfig, c.validate()
+}
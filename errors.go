@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// apiError is an error that knows how it is reported to the client.
+type apiError struct {
+	status  int
+	code    string
+	message string
+	field   string
+}
+
+func (e *apiError) Error() string {
+	if e.field != "" {
+		return e.field + ": " + e.message
+	}
+	return e.message
+}
+
+// errorEnvelope is the JSON body of every error response.
+type errorEnvelope struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+var (
+	errConflictID = &apiError{
+		status:  http.StatusConflict,
+		code:    "conflict",
+		message: "resource id is conflict",
+		field:   "id",
+	}
+	errNotFound = &apiError{
+		status:  http.StatusNotFound,
+		code:    "not_found",
+		message: "resource not found",
+	}
+	errMethodNotAllowed = &apiError{
+		status:  http.StatusMethodNotAllowed,
+		code:    "method_not_allowed",
+		message: "method not allowed",
+	}
+	errInternal = &apiError{
+		status:  http.StatusInternalServerError,
+		code:    "internal",
+		message: "internal server error",
+	}
+)
+
+// envelope returns e as reported in a response body, without a request ID.
+func (e *apiError) envelope() errorEnvelope {
+	return errorEnvelope{
+		Code:    e.code,
+		Message: e.message,
+		Field:   e.field,
+	}
+}
+
+func errMissingField(field string) *apiError {
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "missing_field",
+		message: "field is required",
+		field:   field,
+	}
+}
+
+func errNullField(field string) *apiError {
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "null_field",
+		message: "field must not be null",
+		field:   field,
+	}
+}
+
+func errInvalidField(field string, message string) *apiError {
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "invalid_field",
+		message: message,
+		field:   field,
+	}
+}
+
+// errInvalidBody reports a body that cannot be read or decoded. Type
+// mismatches name the offending field.
+func errInvalidBody(err error) *apiError {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+		return errInvalidField(typeErr.Field, fmt.Sprintf("must be %s", typeErr.Type))
+	}
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "invalid_body",
+		message: err.Error(),
+	}
+}
+
+// writeError reports err to the client. Errors other than *apiError are
+// unexpected and become a 500, with the details only in the server log.
+func (a *api) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		logRequestError(r, "unexpected error", err)
+		apiErr = errInternal
+	}
+
+	if a.config.ContestErrors {
+		writeBareError(w, r, apiErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.status)
+	envelope := apiErr.envelope()
+	envelope.RequestID = requestID(r)
+	err = json.NewEncoder(w).Encode(envelope)
+	if err != nil {
+		logRequestError(r, "encode response", err)
+	}
+}
+
+// writeBareError writes the plain text responses of the original contest
+// server. Errors keep their status and only lose the JSON body, except the
+// ID conflicts of the contest's own endpoints, which it answered with 400.
+func writeBareError(w http.ResponseWriter, r *http.Request, apiErr *apiError) {
+	status := apiErr.status
+	if apiErr == errConflictID {
+		status = http.StatusBadRequest
+	}
+	switch status {
+	case http.StatusNotFound:
+		http.NotFound(w, r)
+	case http.StatusMethodNotAllowed:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case http.StatusInternalServerError:
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+	default:
+		http.Error(w, http.StatusText(status), status)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errPreconditionFailed = &apiError{
+	status:  http.StatusPreconditionFailed,
+	code:    "precondition_failed",
+	message: "resource version does not match the request preconditions",
+}
+
+// etag returns the entity tag of an entity at version. It includes the
+// epoch of d, so tags handed out before a reload never match the reloaded
+// data, whose versions start over.
+func (d *InmemoryDB) etag(version uint32) string {
+	return `"` + strconv.FormatInt(d.epoch, 36) + "-" + strconv.FormatUint(uint64(version), 10) + `"`
+}
+
+// headerList returns all values of the list header name, joined by commas.
+func headerList(r *http.Request, name string) string {
+	return strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+}
+
+// etagListMatches reports whether the If-Match or If-None-Match value list
+// contains etag or is "*". Weak comparison ignores the W/ prefix; strong
+// comparison never matches a weak tag.
+func etagListMatches(list string, etag string, weak bool) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[len("W/"):]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch returns errPreconditionFailed unless ifMatch, the value of
+// an If-Match header, is empty or matches etag.
+func checkIfMatch(ifMatch string, etag string) error {
+	if ifMatch == "" || etagListMatches(ifMatch, etag, false) {
+		return nil
+	}
+	return errPreconditionFailed
+}
+
+// notModified sets the ETag header and, if the request's If-None-Match
+// matches it, answers 304 and returns true.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	ifNoneMatch := headerList(r, "If-None-Match")
+	if ifNoneMatch == "" || !etagListMatches(ifNoneMatch, etag, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// checkPreconditions checks If-Match and If-None-Match for a write that
+// may create the entity. etag is that of the current entity, if it exists.
+// If-Match fails without a current entity, and "If-None-Match: *" lets
+// a write create the entity only.
+func checkPreconditions(exists bool, etag string, ifMatch string, ifNoneMatch string) error {
+	if ifMatch != "" && (!exists || !etagListMatches(ifMatch, etag, false)) {
+		return errPreconditionFailed
+	}
+	if ifNoneMatch != "" && exists && etagListMatches(ifNoneMatch, etag, true) {
+		return errPreconditionFailed
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestETagFollowsWrites(t *testing.T) {
+	db := newTestDB(t, 10, 10, 10)
+	router := newTestAPI(t, db).newRouter()
+
+	for _, target := range []string{"/users/1", "/locations/1", "/visits/1"} {
+		first := serve(router, "GET", target, "").Header().Get("ETag")
+		if first == "" {
+			t.Fatalf("GET %s: no ETag", target)
+		}
+		if again := serve(router, "GET", target, "").Header().Get("ETag"); again != first {
+			t.Errorf("GET %s: ETag %s, then %s", target, first, again)
+		}
+	}
+
+	before := serve(router, "GET", "/users/1", "").Header().Get("ETag")
+	rec := serve(router, "POST", "/users/1", `{"first_name":"Changed"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", rec.Code, rec.Body)
+	}
+	after := serve(router, "GET", "/users/1", "").Header().Get("ETag")
+	if after == before {
+		t.Errorf("ETag %s did not change with the update", after)
+	}
+	if want := db.etag(db.getUser(1).Version); after != want {
+		t.Errorf("ETag %s, want %s", after, want)
+	}
+	// A write to another user leaves the tag alone.
+	serve(router, "POST", "/users/2", `{"first_name":"Changed"}`)
+	if again := serve(router, "GET", "/users/1", "").Header().Get("ETag"); again != after {
+		t.Errorf("ETag %s changed to %s by a write to another user", after, again)
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	db := newTestDB(t, 10, 10, 10)
+	router := newTestAPI(t, db).newRouter()
+	current := db.etag(db.getLocation(1).Version)
+	stale := db.etag(db.getLocation(1).Version + 1)
+
+	tests := []struct {
+		ifNoneMatch string
+		want        int
+	}{
+		{current, http.StatusNotModified},
+		{"W/" + current, http.StatusNotModified},
+		{stale + ", " + current, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+		{stale, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := serve(router, "GET", "/locations/1", "", "If-None-Match", tt.ifNoneMatch)
+		if rec.Code != tt.want {
+			t.Errorf("If-None-Match %s: %d, want %d", tt.ifNoneMatch, rec.Code, tt.want)
+		}
+		if tag := rec.Header().Get("ETag"); tag != current {
+			t.Errorf("If-None-Match %s: ETag %s, want %s", tt.ifNoneMatch, tag, current)
+		}
+		if tt.want == http.StatusNotModified && rec.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: 304 with body %q", tt.ifNoneMatch, rec.Body)
+		}
+	}
+}
+
+func TestIfMatchOnUpdate(t *testing.T) {
+	db := newTestDB(t, 10, 10, 10)
+	router := newTestAPI(t, db).newRouter()
+
+	tests := []struct {
+		target  string
+		body    string
+		version func() uint32
+	}{
+		{"/users/3", `{"email":"changed@example.com"}`, func() uint32 { return db.getUser(3).Version }},
+		{"/locations/3", `{"distance":42}`, func() uint32 { return db.getLocation(3).Version }},
+		{"/visits/3", `{"mark":1}`, func() uint32 { return db.getVisit(3).Version }},
+	}
+	for _, tt := range tests {
+		version := tt.version()
+		stale := db.etag(version + 1)
+		rec := serve(router, "POST", tt.target, tt.body, "If-Match", stale)
+		if rec.Code != http.StatusPreconditionFailed {
+			t.Errorf("POST %s with a stale If-Match: %d, want %d", tt.target, rec.Code, http.StatusPreconditionFailed)
+		}
+		if tt.version() != version {
+			t.Errorf("POST %s with a stale If-Match was applied", tt.target)
+		}
+
+		rec = serve(router, "POST", tt.target, tt.body, "If-Match", db.etag(version))
+		if rec.Code != http.StatusOK || tt.version() != version+1 {
+			t.Errorf("POST %s with the current If-Match: %d, version %d", tt.target, rec.Code, tt.version())
+		}
+		if tag := rec.Header().Get("ETag"); tag != "" && tag != db.etag(version+1) {
+			t.Errorf("POST %s: ETag %s, want %s", tt.target, tag, db.etag(version+1))
+		}
+	}
+}
+
+func TestETagEpochChangesOnReload(t *testing.T) {
+	old := newTestDB(t, 10, 10, 10)
+	router := newTestAPI(t, old).newRouter()
+	before := serve(router, "GET", "/users/1", "").Header().Get("ETag")
+
+	// The reloaded data has the same versions, but the tags handed out for
+	// the old data must not match it.
+	reloaded := newTestDB(t, 10, 10, 10)
+	for reloaded.epoch == old.epoch {
+		reloaded = newTestDB(t, 10, 10, 10)
+	}
+	liveDB.Store(reloaded)
+	if reloaded.getUser(1).Version != old.getUser(1).Version {
+		t.Fatal("the reloaded user has another version")
+	}
+
+	rec := serve(router, "GET", "/users/1", "", "If-None-Match", before)
+	if rec.Code != http.StatusOK {
+		t.Errorf("If-None-Match with a tag from before the reload: %d, want %d", rec.Code, http.StatusOK)
+	}
+	if after := rec.Header().Get("ETag"); after == before {
+		t.Errorf("ETag %s survived the reload", after)
+	}
+	rec = serve(router, "POST", "/users/1", `{"first_name":"Changed"}`, "If-Match", before)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-Match with a tag from before the reload: %d, want %d", rec.Code, http.StatusPreconditionFailed)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of change events.
+const (
+	eventCreate = "create"
+	eventUpdate = "update"
+	eventDelete = "delete"
+)
+
+// changeEvent is a write to InmemoryDB, as sent on GET /events.
+type changeEvent struct {
+	ID      uint64          `json:"-"`
+	Type    string          `json:"type"`
+	Entity  string          `json:"entity"`
+	Key     int32           `json:"id"`
+	Version uint32          `json:"version"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// eventLog keeps the most recent change events in a ring buffer and wakes
+// the streams waiting for new ones. Event IDs start at 1 and increase by
+// one, so a stream can tell from an ID whether it missed events.
+type eventLog struct {
+	mux    sync.Mutex
+	ring   []changeEvent
+	nextID uint64
+	// wake is closed and replaced by every publish.
+	wake   chan struct{}
+	closed bool
+	// journal collects every event published while journaling is set,
+	// however many of them the ring keeps, up to journalLimit. Events past
+	// the limit set overflowed instead.
+	journal      []changeEvent
+	journaling   bool
+	journalLimit int
+	overflowed   bool
+}
+
+func newEventLog(capacity int) *eventLog {
+	return &eventLog{
+		ring:   make([]changeEvent, capacity),
+		nextID: 1,
+		wake:   make(chan struct{}),
+	}
+}
+
+// changeFeed receives the writes of the live InmemoryDB. It outlives
+// reloads, so streams keep going across them.
+var changeFeed = newEventLog(defaultConfig().EventBuffer)
+
+// publish appends an event for a write to the entity with id. data is the
+// new state, or nil for deletes.
+func (l *eventLog) publish(typ string, entity string, id int32, version uint32, data interface{}) {
+	e := changeEvent{
+		Type:    typ,
+		Entity:  entity,
+		Key:     id,
+		Version: version,
+	}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			log.Println("WARNING: change event dropped:", err)
+			return
+		}
+		e.Data = b
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	e.ID = l.nextID
+	l.nextID++
+	l.ring[e.ID%uint64(len(l.ring))] = e
+	if l.journaling {
+		if len(l.journal) < l.journalLimit {
+			l.journal = append(l.journal, e)
+		} else {
+			l.overflowed = true
+		}
+	}
+	// Requests still drain after close, and wake is closed for good then.
+	if !l.closed {
+		close(l.wake)
+		l.wake = make(chan struct{})
+	}
+}
+
+// startJournal starts collecting at most limit published events for
+// stopJournal.
+func (l *eventLog) startJournal(limit int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.journal = nil
+	l.journaling = true
+	l.journalLimit = limit
+	l.overflowed = false
+}
+
+// stopJournal returns the events published since startJournal and stops
+// collecting them. ok is false if more were published than the limit, and
+// the events are then incomplete.
+func (l *eventLog) stopJournal() (events []changeEvent, ok bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	journal, ok := l.journal, !l.overflowed
+	l.journal = nil
+	l.journaling = false
+	l.overflowed = false
+	return journal, ok
+}
+
+// pendingEvent is a change event whose data is not encoded yet.
+type pendingEvent struct {
+	typ     string
+	id      int32
+	version uint32
+	data    interface{}
+}
+
+// shardEvents holds the change events of a write to a shard until the
+// shard lock is released. Encoding and publishing them happens after that,
+// so writers neither wait for each other's JSON encoding nor hold their
+// shard while they wait for the feed. order is taken before the shard lock
+// is released, which keeps the events of a shard in the order of its
+// writes. Events are dropped until the database is attached to a feed.
+type shardEvents struct {
+	entity  string
+	feed    *eventLog
+	pending []pendingEvent
+	order   sync.Mutex
+}
+
+// emit queues an event for the entity with id. data is a copy of the new
+// state, or nil for deletes. The caller must hold the shard lock.
+func (e *shardEvents) emit(typ string, id int32, version uint32, data interface{}) {
+	e.pending = append(e.pending, pendingEvent{typ: typ, id: id, version: version, data: data})
+}
+
+// release unlocks mux, the shard lock, and publishes the queued events.
+func (e *shardEvents) release(mux *timedMutex) {
+	pending := e.pending
+	e.pending = nil
+	if len(pending) == 0 || e.feed == nil {
+		mux.Unlock()
+		return
+	}
+	e.order.Lock()
+	mux.Unlock()
+	for _, p := range pending {
+		e.feed.publish(p.typ, e.entity, p.id, p.version, p.data)
+	}
+	e.order.Unlock()
+}
+
+// since returns the kept events after lastID and a channel closed by the
+// next publish. missed is set if events after lastID were already dropped
+// from the ring, or if lastID was never handed out; the events then follow
+// after instead.
+func (l *eventLog) since(lastID uint64) (events []changeEvent, after uint64, missed bool, wake <-chan struct{}, closed bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	oldest := uint64(1)
+	if l.nextID > uint64(len(l.ring)) {
+		oldest = l.nextID - uint64(len(l.ring))
+	}
+	from := lastID + 1
+	switch {
+	case lastID >= l.nextID:
+		missed = true
+		from = l.nextID
+	case from < oldest:
+		missed = true
+		from = oldest
+	}
+	for id := from; id < l.nextID; id++ {
+		events = append(events, l.ring[id%uint64(len(l.ring))])
+	}
+	return events, from - 1, missed, l.wake, l.closed
+}
+
+// latest returns the ID of the last published event.
+func (l *eventLog) latest() uint64 {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.nextID - 1
+}
+
+// close ends all streams. It is called when the server starts shutting
+// down, which would otherwise wait for them until the drain timeout.
+func (l *eventLog) close() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.wake)
+	}
+}
+
+// eventsHeartbeat is how often an idle stream sends a comment, which keeps
+// proxies from closing it.
+const eventsHeartbeat = 15 * time.Second
+
+var errStreamingUnsupported = &apiError{
+	status:  http.StatusNotImplemented,
+	code:    "streaming_unsupported",
+	message: "event streams need the http engine",
+}
+
+// canFlush reports whether w streams what is flushed. The raw engine
+// buffers whole responses.
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		switch x := w.(type) {
+		case *statusWriter:
+			w = x.ResponseWriter
+		case http.Flusher:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// parseEntityFilter parses the entity query parameter of /events, a comma
+// separated list of users, locations and visits. An empty filter passes
+// everything.
+func parseEntityFilter(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	filter := make(map[string]bool)
+	for _, entity := range strings.Split(s, ",") {
+		if _, ok := entityColumns[entity]; !ok {
+			return nil, errInvalidField("entity", "must list users, locations or visits")
+		}
+		filter[entity] = true
+	}
+	return filter, nil
+}
+
+// writeEvent writes one event in the text/event-stream format.
+func writeEvent(w http.ResponseWriter, id uint64, name string, data []byte) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, name, data)
+	return err
+}
+
+// eventsHandler streams the change events as server-sent events, starting
+// after Last-Event-ID if the client sends one and with new events
+// otherwise. A "missed" event tells the client that events were dropped
+// from the buffer before it could resume, so it has to resync.
+func (a *api) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !canFlush(w) {
+		a.writeError(w, r, errStreamingUnsupported)
+		return
+	}
+	filter, err := parseEntityFilter(r.URL.Query().Get("entity"))
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	feed := changeFeed
+	last := feed.latest()
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		last, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			a.writeError(w, r, errInvalidField("Last-Event-ID", "must be an event ID"))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flush := func() {
+		w.(http.Flusher).Flush()
+	}
+	flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		events, after, missed, wake, closed := feed.since(last)
+		if missed {
+			data := []byte(fmt.Sprintf(`{"last_event_id":%d}`, last))
+			if err := writeEvent(w, after, "missed", data); err != nil {
+				return
+			}
+		}
+		last = after
+		for _, e := range events {
+			last = e.ID
+			if filter != nil && !filter[e.Entity] {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				logRequestError(r, "encode event", err)
+				return
+			}
+			if err := writeEvent(w, e.ID, e.Type, data); err != nil {
+				return
+			}
+		}
+		if missed || len(events) > 0 {
+			flush()
+		}
+		if closed {
+			return
+		}
+
+		select {
+		case <-wake:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
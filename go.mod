@@ -5,4 +5,5 @@ go 1.12
 require (
 	github.com/google/btree v1.0.0
 	github.com/gorilla/mux v1.7.3
+	gopkg.in/yaml.v2 v2.4.0
 )
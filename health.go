@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// startup tracks the initial data load, which runs while the server is
+// already listening.
+var startup struct {
+	// ready is 1 once the data is loaded. It is read on every request.
+	ready int32
+
+	mu          sync.Mutex
+	stage       string
+	started     time.Time
+	filesLoaded int
+	currentFile string
+	loadedIn    time.Duration
+}
+
+// isReady reports whether the initial load has finished.
+func isReady() bool {
+	return atomic.LoadInt32(&startup.ready) == 1
+}
+
+// Startup stages, reported by /readyz.
+const (
+	stageLoading = "loading"
+	stageWarmup  = "warming up"
+	stageReady   = "ready"
+)
+
+func setStartupStage(stage string) {
+	startup.mu.Lock()
+	startup.stage = stage
+	startup.mu.Unlock()
+}
+
+// loadStartupData loads the data into db, which must already be live, warms
+// it up if configured and marks the server ready. A failed load stops the
+// process, as before the listener was started first.
+func (a *api) loadStartupData(db *InmemoryDB, dataPath string) {
+	startup.mu.Lock()
+	startup.stage = stageLoading
+	startup.started = time.Now()
+	startup.mu.Unlock()
+
+	err := loadData(db, dataPath, a.config.LoadPolicy, func(name string) {
+		startup.mu.Lock()
+		if startup.currentFile != "" {
+			startup.filesLoaded++
+		}
+		startup.currentFile = name
+		startup.mu.Unlock()
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	startup.mu.Lock()
+	if startup.currentFile != "" {
+		startup.filesLoaded++
+	}
+	startup.currentFile = ""
+	startup.mu.Unlock()
+
+	if a.config.Warmup.Enabled {
+		setStartupStage(stageWarmup)
+		warmUp(db, a.config.Warmup.Ammo, a.routes())
+	}
+
+	startup.mu.Lock()
+	startup.stage = stageReady
+	startup.loadedIn = time.Since(startup.started)
+	startup.mu.Unlock()
+	atomic.StoreInt32(&startup.ready, 1)
+	log.Println("Ready after", startup.loadedIn)
+}
+
+// availableWhileLoading are the routes that answer before the data is
+// loaded.
+var availableWhileLoading = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+var errNotReady = &apiError{
+	status:  http.StatusServiceUnavailable,
+	code:    "not_ready",
+	message: "data is still loading",
+}
+
+// readinessMiddleware answers 503 on API routes until the data is loaded.
+func (a *api) readinessMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.method == "" || availableWhileLoading[rt.template] {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReady() {
+			w.Header().Set("Retry-After", "1")
+			a.writeError(w, r, errNotReady)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *api) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write([]byte(`{"status":"ok"}`))
+	if err != nil {
+		logRequestError(r, "write response", err)
+	}
+}
+
+// readyzResponse is the response type of GET /readyz
+type readyzResponse struct {
+	Ready       bool   `json:"ready"`
+	Stage       string `json:"stage"`
+	FilesLoaded int    `json:"files_loaded"`
+	CurrentFile string `json:"current_file,omitempty"`
+	Elapsed     string `json:"elapsed"`
+	Users       int    `json:"users"`
+	Locations   int    `json:"locations"`
+	Visits      int    `json:"visits"`
+}
+
+// readyzHandler answers 200 once the data is loaded and 503 before, with
+// the progress of the load either way.
+func (a *api) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready := isReady()
+	startup.mu.Lock()
+	response := readyzResponse{
+		Ready:       ready,
+		Stage:       startup.stage,
+		FilesLoaded: startup.filesLoaded,
+		CurrentFile: startup.currentFile,
+	}
+	if ready {
+		response.Elapsed = startup.loadedIn.String()
+	} else if !startup.started.IsZero() {
+		response.Elapsed = time.Since(startup.started).String()
+	}
+	startup.mu.Unlock()
+
+	response.Users, response.Locations, response.Visits = currentDB().counts()
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", "1")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logRequestError(r, "encode response", err)
+	}
+}
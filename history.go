@@ -0,0 +1,528 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// revision is a state of an entity. A nil entity means the entity was
+// deleted.
+type revision struct {
+	version uint32
+	// at is when the state was written, in Unix nanoseconds. It is 0 for
+	// the state the entity was loaded with.
+	at     int64
+	entity interface{} // *User, *Location or *Visit
+}
+
+// entityHistory holds the kept revisions of an entity, oldest first.
+// truncated is set once revisions were dropped to respect the limit.
+// latest is the state after the last write, kept even if the limit is 0.
+type entityHistory struct {
+	truncated bool
+	revisions []revision
+	latest    revision
+
+	// keys are the keys the revisions of the entity had in the indexes
+	// of the history, and order its place in the eviction order.
+	keys  []historyKey
+	order *list.Element
+}
+
+// historyKey is a key of an entity in the index of a history.
+type historyKey struct {
+	index int
+	key   int32
+}
+
+// historyIndex finds the entities whose revisions had a key, such as the
+// visits that belonged to a user at some point. evicted holds, for each
+// key, the last write of the evicted entities that had it: which entities
+// had the key before then is no longer known.
+type historyIndex struct {
+	key     func(entity interface{}) int32
+	ids     map[int32]map[int32]struct{}
+	evicted map[int32]int64
+}
+
+// history keeps the last revisions of the entities of a shard. Only
+// entities written since the data was loaded have one; the others are
+// still in the state they were loaded with. Revisions are recorded before
+// the write is published, so a reader that finds no history after loading
+// a snapshot knows the snapshot holds the loaded state.
+//
+// The history of at most maxEntities entities is kept. The least recently
+// written ones are evicted, and only the time of their last write is kept
+// in evicted: their states from before it are no longer known. Entities
+// that were never written keep their loaded state from the start, however
+// much was evicted. evicted holds at most an entry per entity of the
+// shard, whatever the number of writes.
+type history struct {
+	mux         sync.Mutex
+	limit       int
+	maxEntities int
+	entities    map[int32]*entityHistory
+	order       *list.List // of IDs, least recently written first
+	evicted     map[int32]int64
+	indexes     []historyIndex
+}
+
+// newHistory returns a history keeping limit revisions of up to
+// maxEntities entities. Each key function adds an index, see ids.
+func newHistory(limit int, maxEntities int, keys ...func(entity interface{}) int32) *history {
+	h := &history{
+		limit:       limit,
+		maxEntities: maxEntities,
+		entities:    make(map[int32]*entityHistory),
+		order:       list.New(),
+		evicted:     make(map[int32]int64),
+	}
+	for _, key := range keys {
+		h.indexes = append(h.indexes, historyIndex{
+			key:     key,
+			ids:     make(map[int32]map[int32]struct{}),
+			evicted: make(map[int32]int64),
+		})
+	}
+	return h
+}
+
+// The indexes of the visit history.
+const (
+	visitHistoryByUser = iota
+	visitHistoryByLocation
+)
+
+func newVisitHistory(limit int, maxEntities int) *history {
+	return newHistory(limit, maxEntities,
+		func(entity interface{}) int32 { return entity.(*Visit).User },
+		func(entity interface{}) int32 { return entity.(*Visit).Location },
+	)
+}
+
+var errHistoryUnavailable = &apiError{
+	status:  http.StatusNotFound,
+	code:    "history_unavailable",
+	message: "the state at asOf is no longer kept",
+	field:   "asOf",
+}
+
+// record adds after, the new state of the entity with id. before is the
+// state it replaces, with a nil entity if it was created; it seeds the
+// history of entities that were loaded, or evicted.
+func (h *history) record(id int32, before revision, after revision) {
+	after.at = time.Now().UnixNano()
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	e := h.entities[id]
+	if e == nil {
+		e = &entityHistory{order: h.order.PushBack(id)}
+		h.entities[id] = e
+		if at, ok := h.evicted[id]; ok {
+			// before was written at the last write before the
+			// eviction, and what came before it is gone.
+			before.at = at
+			e.truncated = true
+			delete(h.evicted, id)
+		}
+		h.addKeys(id, e, before.entity)
+		if before.entity != nil || e.truncated {
+			e.revisions = append(e.revisions, before)
+		}
+	} else {
+		h.order.MoveToBack(e.order)
+	}
+	h.addKeys(id, e, after.entity)
+	e.latest = after
+	e.revisions = append(e.revisions, after)
+	if n := len(e.revisions) - h.limit; n > 0 {
+		e.revisions = append([]revision(nil), e.revisions[n:]...)
+		e.truncated = true
+	}
+
+	for h.order.Len() > h.maxEntities {
+		h.evict(h.order.Front().Value.(int32))
+	}
+}
+
+// addKeys indexes entity as a state of id. The caller must hold h.mux.
+func (h *history) addKeys(id int32, e *entityHistory, entity interface{}) {
+	if entity == nil {
+		return
+	}
+	for i := range h.indexes {
+		k := historyKey{index: i, key: h.indexes[i].key(entity)}
+		known := false
+		for _, old := range e.keys {
+			known = known || old == k
+		}
+		if known {
+			continue
+		}
+		e.keys = append(e.keys, k)
+		ids := h.indexes[i].ids[k.key]
+		if ids == nil {
+			ids = make(map[int32]struct{})
+			h.indexes[i].ids[k.key] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+// evict forgets the history of id but the time of its last write. The
+// caller must hold h.mux.
+func (h *history) evict(id int32) {
+	e := h.entities[id]
+	at := e.latest.at
+	for _, k := range e.keys {
+		index := &h.indexes[k.index]
+		ids := index.ids[k.key]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(index.ids, k.key)
+		}
+		if at > index.evicted[k.key] {
+			index.evicted[k.key] = at
+		}
+	}
+	h.evicted[id] = at
+	h.order.Remove(e.order)
+	delete(h.entities, id)
+}
+
+// get returns a copy of the history of id, or nil if it has none, and
+// whether its history was evicted.
+func (h *history) get(id int32) (*entityHistory, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	e := h.entities[id]
+	if e == nil {
+		_, evicted := h.evicted[id]
+		return nil, evicted
+	}
+	return &entityHistory{
+		truncated: e.truncated,
+		revisions: append([]revision(nil), e.revisions...),
+		latest:    e.latest,
+	}, false
+}
+
+// at returns the state of id at t, in Unix nanoseconds: its entity, or nil
+// if it did not exist. ok is false if id was not written since t, in which
+// case the stored state is the answer.
+func (h *history) at(id int32, t int64) (entity interface{}, ok bool, err error) {
+	h.mux.Lock()
+	e := h.entities[id]
+	evictedAt, evicted := h.evicted[id]
+	var latest revision
+	var revisions []revision
+	truncated := false
+	if e != nil {
+		latest, revisions, truncated = e.latest, e.revisions, e.truncated
+	}
+	h.mux.Unlock()
+
+	switch {
+	case e == nil && evicted && t < evictedAt:
+		return nil, false, errHistoryUnavailable
+	case e == nil:
+		return nil, false, nil
+	case t >= latest.at:
+		return latest.entity, true, nil
+	}
+	// revisions is only ever replaced, never modified in place, so it can
+	// be read without the lock.
+	i := sort.Search(len(revisions), func(i int) bool {
+		return revisions[i].at != 0 && revisions[i].at > t
+	})
+	if i == 0 {
+		if truncated {
+			return nil, true, errHistoryUnavailable
+		}
+		// Created after t.
+		return nil, true, nil
+	}
+	return revisions[i-1].entity, true, nil
+}
+
+// ids returns the IDs of the entities with a history whose revisions had
+// key in the given index. It fails if an entity that had key was evicted
+// after t, since it may have had key at t.
+func (h *history) ids(index int, key int32, t int64) ([]int32, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if t < h.indexes[index].evicted[key] {
+		return nil, errHistoryUnavailable
+	}
+	ids := make([]int32, 0, len(h.indexes[index].ids[key]))
+	for id := range h.indexes[index].ids[key] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// getUserAsOf returns the user with id as it was at t, or nil if it did
+// not exist then.
+func (d *InmemoryDB) getUserAsOf(id int32, t int64) (*User, error) {
+	// Load first, see history.
+	user := d.users.load().get(id)
+	entity, ok, err := d.users.history.at(id, t)
+	if err != nil || !ok {
+		return user, err
+	}
+	user, _ = entity.(*User)
+	return user, nil
+}
+
+func (d *InmemoryDB) getLocationAsOf(id int32, t int64) (*Location, error) {
+	location := d.locations.load().get(id)
+	entity, ok, err := d.locations.history.at(id, t)
+	if err != nil || !ok {
+		return location, err
+	}
+	location, _ = entity.(*Location)
+	return location, nil
+}
+
+func (d *InmemoryDB) getVisitAsOf(id int32, t int64) (*Visit, error) {
+	visit := d.visits.load().get(id)
+	entity, ok, err := d.visits.history.at(id, t)
+	if err != nil || !ok {
+		return visit, err
+	}
+	visit, _ = entity.(*Visit)
+	return visit, nil
+}
+
+// visitIDsAsOf returns the IDs of the visits that may have had owner at t:
+// current is the list of owner from a visit index, and the visits whose
+// history has owner in the given index are added to it.
+func (d *InmemoryDB) visitIDsAsOf(current []int32, index int, owner int32, t int64) ([]int32, error) {
+	written, err := d.visits.history.ids(index, owner, t)
+	if err != nil {
+		return nil, err
+	}
+	ids := append([]int32(nil), current...)
+	ids = append(ids, written...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	n := 0
+	for i, id := range ids {
+		if i == 0 || id != ids[n-1] {
+			ids[n] = id
+			n++
+		}
+	}
+	return ids[:n], nil
+}
+
+// queryVisitsAsOf is queryVisits over the state at t.
+func (d *InmemoryDB) queryVisitsAsOf(userID int32, t int64, fromDate int64, toDate int64, country string, toDistance int64) ([]VisitPlace, error) {
+	ids, err := d.visitIDsAsOf(d.visits.load().visitsByUser.get(userID), visitHistoryByUser, userID, t)
+	if err != nil {
+		return nil, err
+	}
+	visits := make([]VisitPlace, 0)
+	for _, id := range ids {
+		v, err := d.getVisitAsOf(id, t)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil || v.User != userID {
+			continue
+		}
+		if fromDate >= v.VisitedAt || toDate <= v.VisitedAt {
+			continue
+		}
+		location, err := d.getLocationAsOf(v.Location, t)
+		if err != nil {
+			return nil, err
+		}
+		if location == nil {
+			continue
+		}
+		if len(country) != 0 && country != location.Country {
+			continue
+		}
+		if toDistance <= location.Distance {
+			continue
+		}
+		visits = append(visits, VisitPlace{
+			Mark:      v.Mark,
+			VisitedAt: v.VisitedAt,
+			Place:     location.Place,
+		})
+	}
+	sort.Sort(visitsByTime(visits))
+	return visits, nil
+}
+
+// queryAverageAsOf is queryAverage over the state at t.
+func (d *InmemoryDB) queryAverageAsOf(locationID int32, t int64, fromDate int64, toDate int64, fromAge int64, toAge int64, gender string) (float64, error) {
+	count := int64(0)
+	sum := int64(0)
+	ids, err := d.visitIDsAsOf(d.visits.load().visitsByLocation.get(locationID), visitHistoryByLocation, locationID, t)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		v, err := d.getVisitAsOf(id, t)
+		if err != nil {
+			return 0, err
+		}
+		if v == nil || v.Location != locationID {
+			continue
+		}
+		if fromDate >= v.VisitedAt || toDate <= v.VisitedAt {
+			continue
+		}
+		user, err := d.getUserAsOf(v.User, t)
+		if err != nil {
+			return 0, err
+		}
+		if user == nil {
+			continue
+		}
+		if len(gender) != 0 && gender != user.Gender {
+			continue
+		}
+		age := computeAge(user.BirthDate, d.ageReference)
+		if fromAge > age || toAge <= age {
+			continue
+		}
+		count++
+		sum += int64(v.Mark)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return float64(sum) / float64(count), nil
+}
+
+// parseAsOf returns the asOf query parameter in Unix nanoseconds. It is
+// either Unix seconds, like the dates of the data, or an RFC 3339 time.
+// ok is false if the parameter is absent.
+func parseAsOf(r *http.Request) (t int64, ok bool, err error) {
+	s := r.URL.Query().Get("asOf")
+	if s == "" {
+		return 0, false, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if seconds > math.MaxInt64/int64(time.Second) || seconds < math.MinInt64/int64(time.Second) {
+			return 0, false, errInvalidField("asOf", "is out of range")
+		}
+		return seconds * int64(time.Second), true, nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, false, errInvalidField("asOf", "must be Unix seconds or an RFC 3339 time")
+	}
+	return at.UnixNano(), true, nil
+}
+
+// historyRevision is an item of the response of the history endpoints.
+type historyRevision struct {
+	Version uint32      `json:"version"`
+	At      string      `json:"at,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+	Entity  interface{} `json:"entity,omitempty"`
+}
+
+// historyResponse is the response type of /{entity}/{id}/history. The
+// first revision has no "at" if it is the loaded state, and truncated is
+// set if older revisions were dropped.
+type historyResponse struct {
+	Truncated bool              `json:"truncated"`
+	Revisions []historyRevision `json:"revisions"`
+}
+
+// writeHistory answers a history request for id. current is the stored
+// entity, used when id has no history; it must be nil, not a typed nil,
+// if the entity does not exist.
+func (a *api) writeHistory(w http.ResponseWriter, r *http.Request, h *history, id int32, current interface{}, version uint32) {
+	response := historyResponse{Revisions: make([]historyRevision, 0)}
+	e, evicted := h.get(id)
+	switch {
+	case e != nil && len(e.revisions) > 0:
+		response.Truncated = e.truncated
+		for _, rev := range e.revisions {
+			item := historyRevision{
+				Version: rev.version,
+				Deleted: rev.entity == nil,
+				Entity:  rev.entity,
+			}
+			if rev.at != 0 {
+				item.At = time.Unix(0, rev.at).UTC().Format(time.RFC3339Nano)
+			}
+			response.Revisions = append(response.Revisions, item)
+		}
+	case current != nil:
+		// The entity was not written since it was loaded, or its
+		// revisions are not kept.
+		response.Truncated = e != nil || evicted
+		response.Revisions = append(response.Revisions, historyRevision{
+			Version: version,
+			Entity:  current,
+		})
+	default:
+		a.writeError(w, r, errNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logRequestError(r, "encode response", err)
+	}
+}
+
+func (a *api) userHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseInt32(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeError(w, r, errNotFound)
+		return
+	}
+	db := currentDB()
+	// Load before reading the history, see history.
+	if user := db.getUser(id); user != nil {
+		a.writeHistory(w, r, db.users.history, id, user, user.Version)
+		return
+	}
+	a.writeHistory(w, r, db.users.history, id, nil, 0)
+}
+
+func (a *api) locationHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseInt32(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeError(w, r, errNotFound)
+		return
+	}
+	db := currentDB()
+	if location := db.getLocation(id); location != nil {
+		a.writeHistory(w, r, db.locations.history, id, location, location.Version)
+		return
+	}
+	a.writeHistory(w, r, db.locations.history, id, nil, 0)
+}
+
+func (a *api) visitHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseInt32(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeError(w, r, errNotFound)
+		return
+	}
+	db := currentDB()
+	if visit := db.getVisit(id); visit != nil {
+		a.writeHistory(w, r, db.visits.history, id, visit, visit.Version)
+		return
+	}
+	a.writeHistory(w, r, db.visits.history, id, nil, 0)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// now returns the current time in Unix nanoseconds, as history records it.
+func now() int64 {
+	return time.Now().UnixNano()
+}
+
+// newLoadedDB returns a database that loaded the given number of users,
+// locations and visits, like the data files are loaded: none of them has a
+// history.
+func newLoadedDB(historyLimit int, historyEntities int, users int, locations int, visits int) *InmemoryDB {
+	db := newInmemoryDB(BTreeDegree, defaultAgeReference, historyLimit, historyEntities)
+	db.loadUsers(testUsers(1, users), false)
+	db.loadLocations(testLocations(1, locations), false)
+	db.loadVisits(testVisits(1, visits, users, locations), false)
+	return db
+}
+
+func TestAsOfWithoutRevisions(t *testing.T) {
+	db := newLoadedDB(0, 10, 2, 0, 0)
+	before := now()
+	email := "changed@example.com"
+	db.updateUser(1, &UserUpdate{Email: &email}, "")
+
+	// An entity that was only loaded answers from its stored state.
+	if e, _ := db.users.history.get(2); e != nil {
+		t.Fatal("loaded user has a history")
+	}
+	if user, err := db.getUserAsOf(2, before); err != nil || user == nil || user.ID != 2 {
+		t.Errorf("unwritten user: %v, %v", user, err)
+	}
+	// A written one still answers for times after its last write.
+	if user, err := db.getUserAsOf(1, now()); err != nil || user == nil || user.Email != email {
+		t.Errorf("written user now: %v, %v", user, err)
+	}
+	if _, err := db.getUserAsOf(1, before); err != errHistoryUnavailable {
+		t.Errorf("written user before the write: err = %v, want %v", err, errHistoryUnavailable)
+	}
+}
+
+func TestHistoryEviction(t *testing.T) {
+	db := newLoadedDB(4, 2, 3, 0, 0)
+	loaded := now()
+	for id := int32(1); id <= 3; id++ {
+		email := "changed@example.com"
+		db.updateUser(id, &UserUpdate{Email: &email}, "")
+	}
+
+	if n := len(db.users.history.entities); n != 2 {
+		t.Fatalf("%d histories kept, want 2", n)
+	}
+	// User 1 was written least recently, so its history is gone and its
+	// loaded state is no longer known.
+	if _, err := db.getUserAsOf(1, loaded); err != errHistoryUnavailable {
+		t.Errorf("evicted user: err = %v, want %v", err, errHistoryUnavailable)
+	}
+	// Users 2 and 3 still have theirs.
+	if user, err := db.getUserAsOf(3, loaded); err != nil || user == nil || user.Email != "user3@example.com" {
+		t.Errorf("kept user: %v, %v", user, err)
+	}
+	if user, err := db.getUserAsOf(1, now()); err != nil || user == nil || user.Email != "changed@example.com" {
+		t.Errorf("evicted user now: %v, %v", user, err)
+	}
+}
+
+func TestVisitHistoryIndex(t *testing.T) {
+	db := newLoadedDB(4, 10, 3, 3, 0)
+	db.loadVisits([]*Visit{{ID: 1, User: 1, Location: 1, VisitedAt: 1000, Mark: 3}}, false)
+	moved := now()
+	user := int32(2)
+	db.updateVisit(1, &VisitUpdate{User: &user}, "")
+
+	if ids, err := db.visits.history.ids(visitHistoryByUser, 1, 0); len(ids) != 1 || ids[0] != 1 || err != nil {
+		t.Errorf("visits that belonged to user 1: %v, %v, want [1]", ids, err)
+	}
+	if ids, err := db.visits.history.ids(visitHistoryByUser, 3, 0); len(ids) != 0 || err != nil {
+		t.Errorf("visits that belonged to user 3: %v, %v, want none", ids, err)
+	}
+	visits, err := db.queryVisitsAsOf(1, moved, 0, 1<<40, "", 1000)
+	if err != nil || len(visits) != 1 {
+		t.Errorf("visits of user 1 before the move: %v, %v", visits, err)
+	}
+	visits, err = db.queryVisitsAsOf(1, now(), 0, 1<<40, "", 1000)
+	if err != nil || len(visits) != 0 {
+		t.Errorf("visits of user 1 after the move: %v, %v", visits, err)
+	}
+}
+
+// TestAsOfAfterEviction evicts the histories of written visits and checks
+// that the aggregate queries still answer for the past over visits that
+// were only loaded, and refuse to where an evicted visit was involved.
+func TestAsOfAfterEviction(t *testing.T) {
+	// Users 1 to 4, locations 1 to 4; visit i belongs to user 1+i%4 and
+	// location 1+7i%4.
+	db := newLoadedDB(4, 2, 4, 4, 40)
+	loaded := now()
+	wantVisits := db.queryVisits(1, 0, 1<<40, "", 1000)
+	wantAverage := db.queryAverage(1, 0, 1<<40, 0, 1000, "")
+
+	// Move three visits of user 2 at location 4 to user 3. The first
+	// one's history is evicted.
+	user := int32(3)
+	for _, id := range []int32{1, 5, 9} {
+		db.updateVisit(id, &VisitUpdate{User: &user}, "")
+	}
+	if _, evicted := db.visits.history.get(1); !evicted {
+		t.Fatal("the history of visit 1 was not evicted")
+	}
+
+	// User 1 and location 1 only have loaded visits.
+	visits, err := db.queryVisitsAsOf(1, loaded, 0, 1<<40, "", 1000)
+	if err != nil || len(visits) != len(wantVisits) {
+		t.Errorf("visits of user 1 at the load: %d, %v; want %d", len(visits), err, len(wantVisits))
+	}
+	average, err := db.queryAverageAsOf(1, loaded, 0, 1<<40, 0, 1000, "")
+	if err != nil || average != wantAverage {
+		t.Errorf("average of location 1 at the load: %v, %v; want %v", average, err, wantAverage)
+	}
+	if user, err := db.getUserAsOf(4, loaded); err != nil || user == nil {
+		t.Errorf("loaded user 4 at the load: %v, %v", user, err)
+	}
+
+	// Visit 1 belonged to user 2 and location 4 at the load, and what
+	// else did is no longer known.
+	if _, err := db.queryVisitsAsOf(2, loaded, 0, 1<<40, "", 1000); err != errHistoryUnavailable {
+		t.Errorf("visits of user 2 at the load: err = %v, want %v", err, errHistoryUnavailable)
+	}
+	if _, err := db.queryAverageAsOf(4, loaded, 0, 1<<40, 0, 1000, ""); err != errHistoryUnavailable {
+		t.Errorf("average of location 4 at the load: err = %v, want %v", err, errHistoryUnavailable)
+	}
+	if _, err := db.getVisitAsOf(1, loaded); err != errHistoryUnavailable {
+		t.Errorf("evicted visit at the load: err = %v, want %v", err, errHistoryUnavailable)
+	}
+	// After the moves, everything is known again.
+	if visits, err := db.queryVisitsAsOf(2, now(), 0, 1<<40, "", 1000); err != nil || len(visits) != 7 {
+		t.Errorf("visits of user 2 now: %d, %v; want 7", len(visits), err)
+	}
+
+	// Writing visit 1 again starts a history that begins at its last
+	// write before the eviction.
+	mark := int8(0)
+	db.updateVisit(1, &VisitUpdate{Mark: &mark}, "")
+	if _, err := db.getVisitAsOf(1, loaded); err != errHistoryUnavailable {
+		t.Errorf("rewritten visit at the load: err = %v, want %v", err, errHistoryUnavailable)
+	}
+}
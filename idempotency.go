@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKey is the longest Idempotency-Key accepted.
+const maxIdempotencyKey = 255
+
+var (
+	errIdempotencyMismatch = &apiError{
+		status:  http.StatusUnprocessableEntity,
+		code:    "idempotency_key_reused",
+		message: "Idempotency-Key was used with a different body",
+		field:   "Idempotency-Key",
+	}
+	errIdempotencyInProgress = &apiError{
+		status:  http.StatusConflict,
+		code:    "idempotency_in_progress",
+		message: "a request with this Idempotency-Key is in progress",
+		field:   "Idempotency-Key",
+	}
+)
+
+// recordedResponse is a response kept for replays.
+type recordedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyEntry is the state of a key: in progress until the first
+// request finishes, then its response until expires.
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	done        bool
+	response    recordedResponse
+	expires     time.Time
+	// order is the entry's place in the eviction order.
+	order *list.Element
+}
+
+// idempotencyCache maps route paths and keys to their entries. Expired
+// entries are swept on the way when a key is added, and once maxEntries
+// keys are held the oldest ones are dropped to make room.
+type idempotencyCache struct {
+	mux       sync.Mutex
+	entries   map[string]*idempotencyEntry
+	order     *list.List // of keys, oldest first
+	lastSweep time.Time
+}
+
+var idempotencyKeys = newIdempotencyCache()
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		entries: make(map[string]*idempotencyEntry),
+		order:   list.New(),
+	}
+}
+
+// begin returns the entry to replay for key, or nil if the caller should
+// run the request and then call finish.
+func (c *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte, ttl time.Duration, maxEntries int) (*idempotencyEntry, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) > ttl/4 {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				c.remove(k, e)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	e := c.entries[key]
+	if e != nil && now.After(e.expires) {
+		c.remove(key, e)
+		e = nil
+	}
+	switch {
+	case e == nil:
+		// A dropped key that is still in progress is not replayed, so a
+		// retry of it may run twice. That only happens to the oldest of
+		// maxEntries keys.
+		for c.order.Len() >= maxEntries {
+			k := c.order.Front().Value.(string)
+			c.remove(k, c.entries[k])
+		}
+		c.entries[key] = &idempotencyEntry{
+			fingerprint: fingerprint,
+			expires:     now.Add(ttl),
+			order:       c.order.PushBack(key),
+		}
+		return nil, nil
+	case e.fingerprint != fingerprint:
+		return nil, errIdempotencyMismatch
+	case !e.done:
+		return nil, errIdempotencyInProgress
+	default:
+		return e, nil
+	}
+}
+
+// remove forgets key. The caller must hold c.mux.
+func (c *idempotencyCache) remove(key string, e *idempotencyEntry) {
+	c.order.Remove(e.order)
+	delete(c.entries, key)
+}
+
+// len returns the number of keys held.
+func (c *idempotencyCache) len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.entries)
+}
+
+// finish keeps response for key if it is a success and releases the key
+// otherwise, so a failed request can be retried with it.
+func (c *idempotencyCache) finish(key string, response *recordedResponse, ttl time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e := c.entries[key]
+	if e == nil {
+		return
+	}
+	if response == nil || response.status < 200 || response.status > 299 {
+		c.remove(key, e)
+		return
+	}
+	e.done = true
+	e.response = *response
+	e.expires = time.Now().Add(ttl)
+}
+
+// recordingWriter is an http.ResponseWriter that keeps the response.
+type recordingWriter struct {
+	response recordedResponse
+	buf      bytes.Buffer
+}
+
+func newRecordingWriter() *recordingWriter {
+	return &recordingWriter{
+		response: recordedResponse{header: make(http.Header)},
+	}
+}
+
+func (w *recordingWriter) Header() http.Header {
+	return w.response.header
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.response.status == 0 {
+		w.response.status = status
+	}
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.buf.Write(p)
+}
+
+// recorded returns the response written so far.
+func (w *recordingWriter) recorded() *recordedResponse {
+	w.WriteHeader(http.StatusOK)
+	w.response.body = w.buf.Bytes()
+	return &w.response
+}
+
+func writeRecorded(w http.ResponseWriter, r *http.Request, response *recordedResponse) {
+	for k, v := range response.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(response.status)
+	if _, err := w.Write(response.body); err != nil {
+		logRequestError(r, "write response", err)
+	}
+}
+
+// idempotent makes next honour the Idempotency-Key header. The first
+// successful response for a key is kept for the configured IdempotencyTTL,
+// or until IdempotencyKeys newer keys push it out, and replayed to later
+// requests with the same key and body, so a client can retry a create that
+// timed out. Keys are scoped to the request path and to
+// the live database: after a reload, a key no longer replays a response
+// about data that was replaced. The write gate keeps the database from
+// being replaced while the request runs.
+func (a *api) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			a.writeError(w, r, errInvalidField("Idempotency-Key", "must be at most 255 characters"))
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logClientError(r, "read body", err)
+			a.writeError(w, r, errInvalidBody(err))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		ttl := time.Duration(a.config.IdempotencyTTL)
+		key = strconv.FormatInt(currentDB().epoch, 36) + " " + r.URL.Path + " " + key
+		e, err := idempotencyKeys.begin(key, sha256.Sum256(body), ttl, a.config.IdempotencyKeys)
+		if err != nil {
+			a.writeError(w, r, err)
+			return
+		}
+		if e != nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeRecorded(w, r, &e.response)
+			return
+		}
+
+		finished := false
+		defer func() {
+			// Release the key if next panics.
+			if !finished {
+				idempotencyKeys.finish(key, nil, ttl)
+			}
+		}()
+		rec := newRecordingWriter()
+		next(rec, r)
+		response := rec.recorded()
+		idempotencyKeys.finish(key, response, ttl)
+		finished = true
+		writeRecorded(w, r, response)
+	}
+}
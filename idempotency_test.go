@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const newUserBody = `{"id":500,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`
+
+// idempotentRequest sends body to target through handler with the given
+// Idempotency-Key.
+func idempotentRequest(handler http.Handler, target string, key string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	idempotencyKeys = newIdempotencyCache()
+	router := newTestAPI(t, newTestDB(t, 10, 10, 10)).newRouter()
+
+	first := idempotentRequest(router, "/users/new", "create-500", newUserBody)
+	if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first create: %d, replayed %q", first.Code, first.Header().Get("Idempotent-Replayed"))
+	}
+	retry := idempotentRequest(router, "/users/new", "create-500", newUserBody)
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry was not replayed: %d %s", retry.Code, retry.Body)
+	}
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry = %d %q, want %d %q", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	// Running the create again would fail, the user exists.
+	if rec := idempotentRequest(router, "/users/new", "", newUserBody); rec.Code == http.StatusOK {
+		t.Error("create without key succeeded, the first create did not run")
+	}
+}
+
+func TestIdempotencyKeyReusedWithOtherBody(t *testing.T) {
+	idempotencyKeys = newIdempotencyCache()
+	router := newTestAPI(t, newTestDB(t, 10, 10, 10)).newRouter()
+
+	if rec := idempotentRequest(router, "/users/new", "create-500", newUserBody); rec.Code != http.StatusOK {
+		t.Fatalf("first create: %d %s", rec.Code, rec.Body)
+	}
+	other := strings.Replace(newUserBody, "a@b.c", "x@y.z", 1)
+	if rec := idempotentRequest(router, "/users/new", "create-500", other); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("other body: %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	idempotencyKeys = newIdempotencyCache()
+	a := newTestAPI(t, newTestDB(t, 10, 10, 10))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := a.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("{}"))
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- idempotentRequest(handler, "/users/new", "slow", newUserBody)
+	}()
+	<-started
+	if rec := idempotentRequest(handler, "/users/new", "slow", newUserBody); rec.Code != http.StatusConflict {
+		t.Errorf("concurrent retry: %d, want %d", rec.Code, http.StatusConflict)
+	}
+	close(release)
+	if rec := <-done; rec.Code != http.StatusOK {
+		t.Errorf("first request: %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := idempotentRequest(handler, "/users/new", "slow", newUserBody); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry after the first request finished was not replayed: %d", rec.Code)
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	idempotencyKeys = newIdempotencyCache()
+	a := newTestAPI(t, newTestDB(t, 10, 10, 10))
+	a.config.IdempotencyTTL = Duration(time.Millisecond)
+	var calls int32
+	handler := a.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte("{}"))
+	})
+
+	idempotentRequest(handler, "/users/new", "key", newUserBody)
+	time.Sleep(2 * time.Millisecond)
+	rec := idempotentRequest(handler, "/users/new", "key", newUserBody)
+	if rec.Header().Get("Idempotent-Replayed") != "" || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("expired key was replayed, handler ran %d times", calls)
+	}
+}
+
+func TestIdempotencyCacheDropsOldestKeys(t *testing.T) {
+	const maxEntries = 3
+	c := newIdempotencyCache()
+	var fingerprint [sha256.Size]byte
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := c.begin(key, fingerprint, time.Hour, maxEntries); err != nil {
+			t.Fatalf("begin(%s): %v", key, err)
+		}
+		if n := c.len(); n > maxEntries {
+			t.Fatalf("%d keys held after %s, want at most %d", n, key, maxEntries)
+		}
+	}
+	// c, d and e are still in progress, a and b were dropped.
+	for _, key := range []string{"c", "d", "e"} {
+		if _, err := c.begin(key, fingerprint, time.Hour, maxEntries); err != errIdempotencyInProgress {
+			t.Errorf("begin(%s) = %v, want %v", key, err, errIdempotencyInProgress)
+		}
+	}
+	if _, err := c.begin("a", fingerprint, time.Hour, maxEntries); err != nil {
+		t.Errorf("begin(a) = %v, want a new entry", err)
+	}
+}
+
+func TestIdempotencyKeyScopedToDatabase(t *testing.T) {
+	idempotencyKeys = newIdempotencyCache()
+	router := newTestAPI(t, newTestDB(t, 10, 10, 10)).newRouter()
+	create := func() *httptest.ResponseRecorder {
+		return idempotentRequest(router, "/users/new", "create-500", newUserBody)
+	}
+
+	if rec := create(); rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first create: %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if rec := create(); rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry: %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+
+	// A reload replaces the database; the key must not replay a create
+	// that the new data does not have.
+	db := newTestDB(t, 10, 10, 10)
+	liveDB.Store(db)
+	if rec := create(); rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("create after reload: %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if db.getUser(500) == nil {
+		t.Error("user 500 was not created in the reloaded database")
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Import formats. Both hold one entity per row.
+const (
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+// maxImportLine is the longest NDJSON line that can be imported.
+const maxImportLine = 1 << 20
+
+// entityColumns are the fields of each entity type, as named in JSON and in
+// CSV headers.
+var entityColumns = map[string][]string{
+	"users":     {"id", "email", "first_name", "last_name", "gender", "birth_date"},
+	"locations": {"id", "place", "country", "city", "distance"},
+	"visits":    {"id", "location", "user", "visited_at", "mark"},
+}
+
+// numericColumns are the CSV columns that are written as JSON numbers.
+var numericColumns = map[string]bool{
+	"id":         true,
+	"birth_date": true,
+	"distance":   true,
+	"location":   true,
+	"user":       true,
+	"visited_at": true,
+	"mark":       true,
+}
+
+// entityOfColumns tells the entity type from the fields of a row, or
+// returns "" if they do not.
+func entityOfColumns(columns []string) string {
+	for _, column := range columns {
+		switch column {
+		case "email":
+			return "users"
+		case "place":
+			return "locations"
+		case "visited_at":
+			return "visits"
+		}
+	}
+	return ""
+}
+
+// formatOfExt returns the import format of a file extension, or "".
+func formatOfExt(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	case ".csv":
+		return formatCSV
+	}
+	return ""
+}
+
+// formatOfContentType returns the import format of a Content-Type, or "".
+func formatOfContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		return formatNDJSON
+	case "text/csv":
+		return formatCSV
+	}
+	return ""
+}
+
+// importRowError is a row that was not imported. For CSV, Line counts
+// records, the header being line 1.
+type importRowError struct {
+	Line  int           `json:"line"`
+	ID    *int32        `json:"id,omitempty"`
+	Error errorEnvelope `json:"error"`
+
+	err *apiError
+}
+
+// importRow is a row that passed validation.
+type importRow struct {
+	line int
+	id   int32
+}
+
+// importBatch holds the decoded rows of one import.
+type importBatch struct {
+	entity    string
+	rows      int
+	users     []*User
+	locations []*Location
+	visits    []*Visit
+	valid     []importRow
+	errors    []importRowError
+}
+
+func (b *importBatch) fail(line int, id *int32, err error) {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		apiErr = errInvalidBody(err)
+	}
+	b.errors = append(b.errors, importRowError{
+		Line:  line,
+		ID:    id,
+		Error: apiErr.envelope(),
+		err:   apiErr,
+	})
+}
+
+// addRow decodes a row, given as a JSON object, with the same validation as
+// the /new handlers.
+func (b *importBatch) addRow(line int, raw []byte) {
+	b.rows++
+	var id *int32
+	var err error
+	switch b.entity {
+	case "users":
+		var newUser NewUser
+		err = json.Unmarshal(raw, &newUser)
+		id = newUser.ID
+		if err == nil {
+			err = newUser.validate()
+		}
+		if err == nil {
+			b.users = append(b.users, newUser.user())
+		}
+	case "locations":
+		var newLocation NewLocation
+		err = json.Unmarshal(raw, &newLocation)
+		id = newLocation.ID
+		if err == nil {
+			err = newLocation.validate()
+		}
+		if err == nil {
+			b.locations = append(b.locations, newLocation.location())
+		}
+	case "visits":
+		var newVisit NewVisit
+		err = json.Unmarshal(raw, &newVisit)
+		id = newVisit.ID
+		if err == nil {
+			err = newVisit.validate()
+		}
+		if err == nil {
+			b.visits = append(b.visits, newVisit.visit())
+		}
+	}
+	if err != nil {
+		b.fail(line, id, err)
+		return
+	}
+	b.valid = append(b.valid, importRow{line: line, id: *id})
+}
+
+// apply stores the valid rows in db under one lock and returns how many
+// were stored. Rows whose ID is taken are added to the errors.
+func (b *importBatch) apply(db *InmemoryDB) int {
+	var errs []error
+	switch {
+	case len(b.users) > 0:
+		errs = db.addUsers(b.users)
+	case len(b.locations) > 0:
+		errs = db.addLocations(b.locations)
+	case len(b.visits) > 0:
+		errs = db.addVisits(b.visits)
+	}
+
+	imported := 0
+	for i, err := range errs {
+		if err != nil {
+			id := b.valid[i].id
+			b.fail(b.valid[i].line, &id, err)
+			continue
+		}
+		imported++
+	}
+	sort.SliceStable(b.errors, func(i, j int) bool {
+		return b.errors[i].Line < b.errors[j].Line
+	})
+	return imported
+}
+
+// readImport decodes rows of the given entity type, or of the type told by
+// the first row if entity is empty. Errors of single rows are collected in
+// the batch; an error is returned only if the input as a whole is unusable.
+func readImport(entity string, format string, r io.Reader) (*importBatch, error) {
+	switch format {
+	case formatNDJSON:
+		return readNDJSON(entity, r)
+	case formatCSV:
+		return readCSV(entity, r)
+	}
+	return nil, errInvalidField("format", "must be ndjson or csv")
+}
+
+func readNDJSON(entity string, r io.Reader) (*importBatch, error) {
+	b := &importBatch{entity: entity}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		if b.entity == "" {
+			var fields map[string]json.RawMessage
+			if json.Unmarshal(raw, &fields) == nil {
+				columns := make([]string, 0, len(fields))
+				for column := range fields {
+					columns = append(columns, column)
+				}
+				b.entity = entityOfColumns(columns)
+			}
+			if b.entity == "" {
+				return nil, errInvalidField("entity", fmt.Sprintf("line %d does not tell the entity type", line))
+			}
+		}
+		b.addRow(line, raw)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errInvalidBody(err)
+	}
+	return b, nil
+}
+
+func readCSV(entity string, r io.Reader) (*importBatch, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return &importBatch{entity: entity}, nil
+	}
+	if err != nil {
+		return nil, errInvalidBody(err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	if entity == "" {
+		entity = entityOfColumns(header)
+		if entity == "" {
+			return nil, errInvalidField("entity", "the CSV header does not tell the entity type")
+		}
+	}
+	known := make(map[string]bool)
+	for _, column := range entityColumns[entity] {
+		known[column] = true
+	}
+	for _, column := range header {
+		if !known[column] {
+			return nil, errInvalidField(column, "unknown column for "+entity)
+		}
+	}
+
+	b := &importBatch{entity: entity}
+	line := 1
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return b, nil
+		}
+		line++
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			b.rows++
+			b.fail(line, nil, &apiError{
+				status:  http.StatusBadRequest,
+				code:    "invalid_row",
+				message: parseErr.Err.Error(),
+			})
+			continue
+		}
+		if err != nil {
+			return nil, errInvalidBody(err)
+		}
+		b.addRow(line, csvRowJSON(header, record))
+	}
+}
+
+// csvRowJSON writes a CSV row as the JSON object the /new handlers take.
+// Empty cells are left out, so they count as missing fields. Numeric
+// columns that do not hold an integer stay strings and fail to decode with
+// the column named.
+func csvRowJSON(header []string, record []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, column := range header {
+		value := record[i]
+		if value == "" {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(column)
+		buf.Write(key)
+		buf.WriteByte(':')
+		// The integer is written in canonical form, since cells such as
+		// "+5" or "007" are not valid JSON numbers.
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && numericColumns[column] {
+			buf.WriteString(strconv.FormatInt(n, 10))
+		} else {
+			v, _ := json.Marshal(value)
+			buf.Write(v)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// importResponse is the response type of POST /admin/import
+type importResponse struct {
+	Entity   string           `json:"entity"`
+	Format   string           `json:"format"`
+	Rows     int              `json:"rows"`
+	Imported int              `json:"imported"`
+	Failed   int              `json:"failed"`
+	Errors   []importRowError `json:"errors"`
+}
+
+// importHandler adds the rows of an NDJSON or CSV body to the live
+// database. Valid rows are stored even if others fail. The entity and
+// format query parameters default to what the rows and the Content-Type
+// tell.
+func (a *api) importHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	entity := query.Get("entity")
+	if entity != "" && entityColumns[entity] == nil {
+		a.writeError(w, r, errInvalidField("entity", "must be users, locations or visits"))
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = formatOfContentType(r.Header.Get("Content-Type"))
+	}
+
+	b, err := readImport(entity, format, r.Body)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	imported := b.apply(currentDB())
+
+	response := importResponse{
+		Entity:   b.entity,
+		Format:   format,
+		Rows:     b.rows,
+		Imported: imported,
+		Failed:   len(b.errors),
+		Errors:   b.errors,
+	}
+	if response.Errors == nil {
+		response.Errors = []importRowError{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logRequestError(r, "encode response", err)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// dataSource is a set of data files: the entries of a zip or tar.gz, the
+// files of a directory, or a single stream.
+type dataSource interface {
+	// walk calls fn with the name and content of every file, in order.
+	walk(fn func(name string, r io.Reader) error) error
+}
+
+type zipSource struct {
+	path string
+}
+
+func (s zipSource) walk(fn func(name string, r io.Reader) error) error {
+	r, err := zip.OpenReader(s.path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return walkZip(&r.Reader, fn)
+}
+
+func walkZip(r *zip.Reader, fn func(name string, r io.Reader) error) error {
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Limits of a directory data source. A data directory is flat in practice,
+// so anything deeper or larger is most likely the wrong directory.
+const (
+	dirMaxDepth = 4
+	dirMaxFiles = 10000
+)
+
+type dirSource struct {
+	path string
+}
+
+// walk visits the regular files up to dirMaxDepth directories below the
+// source. Symlinks are skipped rather than followed, so the walk stays
+// inside the directory.
+func (s dirSource) walk(fn func(name string, r io.Reader) error) error {
+	var names []string
+	err := filepath.Walk(s.path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			log.Println("WARNING: skipping symlink", p)
+		case info.IsDir():
+			rel, _ := filepath.Rel(s.path, p)
+			if rel != "." && strings.Count(filepath.ToSlash(rel), "/") >= dirMaxDepth {
+				log.Println("WARNING: skipping", p+": more than", dirMaxDepth, "directories deep")
+				return filepath.SkipDir
+			}
+		case info.Mode().IsRegular():
+			if len(names) == dirMaxFiles {
+				return fmt.Errorf("%s: more than %d files", s.path, dirMaxFiles)
+			}
+			names = append(names, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.path, name)
+		err = fn(filepath.ToSlash(rel), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type tarGzSource struct {
+	path string
+}
+
+func (s tarGzSource) walk(fn func(name string, r io.Reader) error) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return walkTarGz(f, fn)
+}
+
+func walkTarGz(r io.Reader, fn func(name string, r io.Reader) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// streamSource is a zip, a tar.gz or a single JSON file read from a stream
+// such as stdin. The format is told by the first bytes.
+type streamSource struct {
+	name string
+	r    io.Reader
+}
+
+func (s streamSource) walk(fn func(name string, r io.Reader) error) error {
+	br := bufio.NewReader(s.r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return walkTarGz(br, fn)
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		// zip keeps its index at the end, so it cannot be streamed.
+		b, err := ioutil.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return err
+		}
+		return walkZip(zr, fn)
+	default:
+		return fn(s.name, br)
+	}
+}
+
+// openDataSource returns the source at p, which is "-" for stdin, a
+// directory, a .zip, a .tar.gz or a single data file. A directory that
+// holds a data.zip stands for that zip, like the contest's /tmp/data.
+func openDataSource(p string) (dataSource, error) {
+	if p == "-" {
+		return streamSource{name: "stdin", r: os.Stdin}, nil
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		zipPath := filepath.Join(p, "data.zip")
+		if _, err := os.Stat(zipPath); err == nil {
+			return zipSource{zipPath}, nil
+		}
+		return dirSource{p}, nil
+	}
+
+	lower := strings.ToLower(p)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return zipSource{p}, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return tarGzSource{p}, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return fileSource{f}, nil
+}
+
+// fileSource is a file of unknown type, read like a stream.
+type fileSource struct {
+	f *os.File
+}
+
+func (s fileSource) walk(fn func(name string, r io.Reader) error) error {
+	defer s.f.Close()
+	return streamSource{name: filepath.Base(s.f.Name()), r: s.f}.walk(fn)
+}
+
+// dataFile is any of the data files. The top-level key tells the entity
+// type when the file name does not.
+type dataFile struct {
+	Users     []*User     `json:"users"`
+	Locations []*Location `json:"locations"`
+	Visits    []*Visit    `json:"visits"`
+}
+
+// entityOfName returns the entity type that a data file name stands for,
+// or "" if the name does not tell.
+func entityOfName(name string) string {
+	base := path.Base(name)
+	for _, entity := range []string{"users", "locations", "visits"} {
+		if strings.HasPrefix(base, entity) {
+			return entity
+		}
+	}
+	return ""
+}
+
+// ignoredDataFiles are known entries that hold no entities.
+var ignoredDataFiles = map[string]bool{
+	"options.txt": true,
+}
+
+// decodeDataFile decodes the entities of a data file: JSON, NDJSON (.ndjson,
+// .jsonl) or CSV (.csv). It returns nil for entries that are not data
+// files, after logging why they are skipped. Rows of NDJSON and CSV files
+// that fail validation are returned apart.
+func decodeDataFile(name string, r io.Reader) (*dataFile, []importRowError, error) {
+	base := path.Base(name)
+	if ignoredDataFiles[base] {
+		return nil, nil, nil
+	}
+	ext := strings.ToLower(path.Ext(base))
+	if format := formatOfExt(ext); format != "" {
+		log.Println("Loading", name)
+		b, err := readImport(entityOfName(name), format, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &dataFile{Users: b.users, Locations: b.locations, Visits: b.visits}, b.errors, nil
+	}
+	if ext != "" && ext != ".json" {
+		log.Printf("WARNING: skipping %s: not a JSON data file", name)
+		return nil, nil, nil
+	}
+
+	log.Println("Loading", name)
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var file dataFile
+	if err := json.Unmarshal(bs, &file); err != nil {
+		return nil, nil, err
+	}
+
+	if file.Users == nil && file.Locations == nil && file.Visits == nil {
+		log.Printf("WARNING: skipping %s: no users, locations or visits key", name)
+		return nil, nil, nil
+	}
+	switch entity := entityOfName(name); {
+	case entity == "users" && file.Users == nil,
+		entity == "locations" && file.Locations == nil,
+		entity == "visits" && file.Visits == nil:
+		log.Printf("WARNING: %s has no %s key, loading it by content", name, entity)
+	}
+	return &file, nil, nil
+}
+
+// maxRowWarnings is how many row errors loading a file logs one by one.
+const maxRowWarnings = 20
+
+func logRowErrors(name string, rowErrs []importRowError) {
+	for i, rowErr := range rowErrs {
+		if i == maxRowWarnings {
+			log.Printf("WARNING: %s: %d more rows skipped", name, len(rowErrs)-i)
+			break
+		}
+		log.Printf("WARNING: %s: line %d skipped: %v", name, rowErr.Line, rowErr.err)
+	}
+}
+
+// Load policies decide what happens when a data load meets an ID that is
+// already loaded, from an earlier file or earlier in the same file.
+const (
+	// loadFail aborts the load.
+	loadFail = "fail"
+	// loadFirstWins keeps the entity loaded first.
+	loadFirstWins = "first-wins"
+	// loadLastWins replaces it with the later one.
+	loadLastWins = "last-wins"
+)
+
+// loadData fills db with the users, locations and visits of the source at
+// p. Entries that are not data files are skipped with a warning. Taken IDs
+// are counted per file and handled according to policy. progress, if not
+// nil, is called with the name of each data file before it is loaded.
+func loadData(db *InmemoryDB, p string, policy string, progress func(name string)) error {
+	source, err := openDataSource(p)
+	if err != nil {
+		return err
+	}
+	return source.walk(func(name string, r io.Reader) error {
+		file, rowErrs, err := decodeDataFile(name, r)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if file == nil {
+			return nil
+		}
+		if progress != nil {
+			progress(name)
+		}
+		logRowErrors(name, rowErrs)
+
+		replace := policy == loadLastWins
+		conflicts := []struct {
+			entity string
+			n      int
+		}{
+			{"user", 0},
+			{"location", 0},
+			{"visit", 0},
+		}
+		if len(file.Users) > 0 {
+			conflicts[0].n = db.loadUsers(file.Users, replace)
+		}
+		if len(file.Locations) > 0 {
+			conflicts[1].n = db.loadLocations(file.Locations, replace)
+		}
+		if len(file.Visits) > 0 {
+			conflicts[2].n = db.loadVisits(file.Visits, replace)
+		}
+
+		for _, c := range conflicts {
+			if c.n == 0 {
+				continue
+			}
+			switch policy {
+			case loadFail:
+				return fmt.Errorf("%s: duplicate %s IDs: %d", name, c.entity, c.n)
+			case loadLastWins:
+				log.Printf("WARNING: %s: duplicate %s IDs: %d, replaced the earlier ones", name, c.entity, c.n)
+			default:
+				log.Printf("WARNING: %s: duplicate %s IDs: %d, kept the earlier ones", name, c.entity, c.n)
+			}
+		}
+		return nil
+	})
+}
@@ -1,26 +1,22 @@
 package main
 
 import (
-	"archive/zip"
 	"encoding/json"
-	"errors"
-	"flag"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
+	"os"
 	"sort"
 	"strconv"
-	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/btree"
 	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
 )
 
-// BTreeDegree is a degree for btree
+// BTreeDegree is the default degree for btree
 const BTreeDegree = 32
 
 // User is the type of users.json in data.zip
@@ -31,6 +27,10 @@ type User struct {
 	LastName  string `json:"last_name"`
 	Gender    string `json:"gender"`
 	BirthDate int64  `json:"birth_date"`
+
+	// Version starts at 1 and is bumped by every update. Handlers send
+	// it as the ETag rather than in the body.
+	Version uint32 `json:"-"`
 }
 
 // Location is the type of locations.json in data.zip
@@ -40,6 +40,8 @@ type Location struct {
 	Country  string `json:"country"`
 	City     string `json:"city"`
 	Distance int64  `json:"distance"`
+
+	Version uint32 `json:"-"`
 }
 
 // Visit is the type of visits.json in data.zip
@@ -49,6 +51,8 @@ type Visit struct {
 	User      int32 `json:"user"`
 	VisitedAt int64 `json:"visited_at"`
 	Mark      int8  `json:"mark"`
+
+	Version uint32 `json:"-"`
 }
 
 // Users is the json type in data.zip
@@ -126,177 +130,1021 @@ type NewVisit struct {
 	Mark      *int8  `json:"mark"`
 }
 
-// InmemoryDB stores everything in memory
-type InmemoryDB struct {
-	mux              sync.RWMutex
-	users            map[int32]*User
-	locations        map[int32]*Location
-	visits           map[int32]*Visit
-	visitsByUser     *btree.BTree
-	visitsByLocation *btree.BTree
+// validate checks that every field of a new user is present.
+func (u *NewUser) validate() error {
+	if u.ID == nil {
+		return errMissingField("id")
+	}
+	if u.Email == nil {
+		return errMissingField("email")
+	}
+	if u.FirstName == nil {
+		return errMissingField("first_name")
+	}
+	if u.LastName == nil {
+		return errMissingField("last_name")
+	}
+	if u.Gender == nil {
+		return errMissingField("gender")
+	}
+	if u.BirthDate == nil {
+		return errMissingField("birth_date")
+	}
+	return nil
+}
+
+// user returns the User described by u, which must have been validated.
+func (u *NewUser) user() *User {
+	return &User{
+		ID:        *u.ID,
+		Email:     *u.Email,
+		FirstName: *u.FirstName,
+		LastName:  *u.LastName,
+		Gender:    *u.Gender,
+		BirthDate: *u.BirthDate,
+	}
 }
 
-// VisitByUserItem is a item of visitsByUser
-type VisitByUserItem struct {
-	userID  int32
-	visitID int32
+func (l *NewLocation) validate() error {
+	if l.ID == nil {
+		return errMissingField("id")
+	}
+	if l.Place == nil {
+		return errMissingField("place")
+	}
+	if l.Country == nil {
+		return errMissingField("country")
+	}
+	if l.City == nil {
+		return errMissingField("city")
+	}
+	if l.Distance == nil {
+		return errMissingField("distance")
+	}
+	return nil
 }
 
-// Less for btree
-func (a VisitByUserItem) Less(bi btree.Item) bool {
-	b := bi.(VisitByUserItem)
-	if a.userID != b.userID {
-		return a.userID < b.userID
+func (l *NewLocation) location() *Location {
+	return &Location{
+		ID:       *l.ID,
+		Place:    *l.Place,
+		Country:  *l.Country,
+		City:     *l.City,
+		Distance: *l.Distance,
 	}
-	return a.visitID < b.visitID
 }
 
-// VisitByLocationItem is a item of visitsByLocation
-type VisitByLocationItem struct {
-	locationID int32
-	visitID    int32
+func (v *NewVisit) validate() error {
+	if v.ID == nil {
+		return errMissingField("id")
+	}
+	if v.Location == nil {
+		return errMissingField("location")
+	}
+	if v.User == nil {
+		return errMissingField("user")
+	}
+	if v.VisitedAt == nil {
+		return errMissingField("visited_at")
+	}
+	if v.Mark == nil {
+		return errMissingField("mark")
+	}
+	return nil
 }
 
-// Less for btree
-func (a VisitByLocationItem) Less(bi btree.Item) bool {
-	b := bi.(VisitByLocationItem)
-	if a.locationID != b.locationID {
-		return a.locationID < b.locationID
+func (v *NewVisit) visit() *Visit {
+	return &Visit{
+		ID:        *v.ID,
+		Location:  *v.Location,
+		User:      *v.User,
+		VisitedAt: *v.VisitedAt,
+		Mark:      *v.Mark,
 	}
-	return a.visitID < b.visitID
 }
 
-func newInmemoryDB() *InmemoryDB {
-	db := InmemoryDB{}
-	db.users = make(map[int32]*User)
-	db.locations = make(map[int32]*Location)
-	db.visits = make(map[int32]*Visit)
-	db.visitsByUser = btree.New(BTreeDegree)
-	db.visitsByLocation = btree.New(BTreeDegree)
+// InmemoryDB stores everything in memory.
+//
+// Each entity type lives in its own shard. Readers never take a lock: they
+// load the shard's published snapshot, a lazy copy of its tables that is
+// never modified afterwards. Writers serialize on the shard lock, modify the
+// shard's working tables and then publish a fresh copy. Writers that touch
+// more than one shard must acquire the locks in this order:
+//
+//	users -> locations -> visits
+//
+// Only InmemoryDB methods take locks, and they never call each other. The
+// methods on the shard and snapshot types are the lock-free building blocks
+// they share, so a lock is never acquired twice on the same call path.
+// Writers release a shard with its unlock method, which publishes their
+// change events once the shard is free for the next writer.
+//
+// The tables keep records by value in ID-indexed chunks (see storage.go), so
+// the garbage collector has little to scan however much data is loaded.
+// User, Location and Visit values are built from the records on each get.
+type InmemoryDB struct {
+	users     userShard
+	locations locationShard
+	visits    visitShard
+	strings   *stringTable
+
+	// epoch tells the ETags of this database from those of the databases
+	// it replaces or is replaced by.
+	epoch int64
+
+	degree       int
+	ageReference time.Time
+}
+
+type userShard struct {
+	mux       timedMutex
+	work      userSnapshot
+	published atomic.Value // *userSnapshot
+	history   *history
+	events    shardEvents
+}
+
+type locationShard struct {
+	mux       timedMutex
+	work      locationSnapshot
+	published atomic.Value // *locationSnapshot
+	history   *history
+	events    shardEvents
+}
+
+type visitShard struct {
+	mux       timedMutex
+	work      visitSnapshot
+	published atomic.Value // *visitSnapshot
+	history   *history
+	events    shardEvents
+}
+
+type userSnapshot struct {
+	users   userTable
+	strings *stringTable
+}
+
+type locationSnapshot struct {
+	locations locationTable
+	strings   *stringTable
+}
+
+// visitSnapshot also holds the secondary indexes since they are only ever
+// modified together with the visits themselves.
+type visitSnapshot struct {
+	visits           visitTable
+	visitsByUser     postingTable
+	visitsByLocation postingTable
+}
+
+// newInmemoryDB creates an empty database whose sparse B-trees have the
+// given degree. Ages in queries are computed at ageReference. Up to
+// historyLimit revisions are kept for each of the last historyEntities
+// entities of each kind written after the load.
+func newInmemoryDB(degree int, ageReference time.Time, historyLimit int, historyEntities int) *InmemoryDB {
+	strings := newStringTable()
+	db := InmemoryDB{
+		strings:      strings,
+		epoch:        time.Now().UnixNano(),
+		degree:       degree,
+		ageReference: ageReference,
+	}
+	db.users.work = userSnapshot{
+		users:   newUserTable(degree),
+		strings: strings,
+	}
+	db.locations.work = locationSnapshot{
+		locations: newLocationTable(degree),
+		strings:   strings,
+	}
+	db.visits.work = visitSnapshot{
+		visits:           newVisitTable(degree),
+		visitsByUser:     newPostingTable(degree),
+		visitsByLocation: newPostingTable(degree),
+	}
+	db.users.history = newHistory(historyLimit, historyEntities)
+	db.locations.history = newHistory(historyLimit, historyEntities)
+	db.visits.history = newVisitHistory(historyLimit, historyEntities)
+	db.users.events.entity = "users"
+	db.locations.events.entity = "locations"
+	db.visits.events.entity = "visits"
+	db.users.publish()
+	db.locations.publish()
+	db.visits.publish()
 	return &db
 }
 
-var (
-	errConflictID = errors.New("resource id is conflict")
-)
+// liveDB holds the *InmemoryDB that requests are served from. It is
+// replaced as a whole when the data is reloaded.
+var liveDB atomic.Value
 
-var (
-	db = newInmemoryDB()
-)
+func init() {
+	cfg := defaultConfig()
+	liveDB.Store(newInmemoryDB(BTreeDegree, defaultAgeReference, cfg.HistoryLimit, cfg.HistoryEntities))
+}
 
-func (d *InmemoryDB) addUser(user *User) error {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+// currentDB returns the live database. A handler that needs it more than
+// once keeps the result, so it never mixes two datasets.
+func currentDB() *InmemoryDB {
+	return liveDB.Load().(*InmemoryDB)
+}
 
-	if _, ok := d.users[user.ID]; ok {
+// attachFeed makes the writes to d publish change events on feed. It must
+// be called before d goes live.
+func (d *InmemoryDB) attachFeed(feed *eventLog) {
+	d.users.events.feed = feed
+	d.locations.events.feed = feed
+	d.visits.events.feed = feed
+}
+
+// counts returns the number of users, locations and visits readers see.
+func (d *InmemoryDB) counts() (int, int, int) {
+	return d.users.load().users.n, d.locations.load().locations.n, d.visits.load().visits.n
+}
+
+// publish makes the current working tables visible to readers. The caller
+// must hold the shard lock.
+func (s *userShard) publish() {
+	s.published.Store(&userSnapshot{
+		users:   s.work.users.snapshot(),
+		strings: s.work.strings,
+	})
+}
+
+func (s *userShard) load() *userSnapshot {
+	return s.published.Load().(*userSnapshot)
+}
+
+// unlock releases the shard lock and then publishes the change events of
+// the write, see shardEvents.
+func (s *userShard) unlock() {
+	s.events.release(&s.mux)
+}
+
+// add inserts user unless its ID is taken. The caller must hold the shard
+// lock and publish afterwards.
+func (s *userShard) add(user *User) error {
+	if s.work.users.has(user.ID) {
 		return errConflictID
 	}
-	d.users[user.ID] = user
+	if err := s.work.admit(user); err != nil {
+		return err
+	}
+	user.Version = 1
+	created := *user
+	s.history.record(user.ID, revision{}, revision{version: 1, entity: &created})
+	s.work.put(user)
 	return nil
 }
 
-func (d *InmemoryDB) removeUser(id int32) *User {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+// put stores user, replacing the user with the same ID if replace is set
+// and keeping it otherwise. A replaced user counts as updated. put reports
+// whether the ID was taken. The caller must hold the shard lock and publish
+// afterwards.
+func (s *userShard) put(user *User, replace bool) bool {
+	old, taken := s.work.users.get(user.ID)
+	if !taken || replace {
+		user.Version = old.version + 1
+		s.work.put(user)
+	}
+	return taken
+}
 
-	var user *User
-	user, ok := d.users[id]
-	if !ok {
-		return nil
+func (s *locationShard) publish() {
+	s.published.Store(&locationSnapshot{
+		locations: s.work.locations.snapshot(),
+		strings:   s.work.strings,
+	})
+}
+
+func (s *locationShard) load() *locationSnapshot {
+	return s.published.Load().(*locationSnapshot)
+}
+
+func (s *locationShard) unlock() {
+	s.events.release(&s.mux)
+}
+
+func (s *locationShard) add(location *Location) error {
+	if s.work.locations.has(location.ID) {
+		return errConflictID
+	}
+	if err := s.work.admit(location); err != nil {
+		return err
 	}
+	location.Version = 1
+	created := *location
+	s.history.record(location.ID, revision{}, revision{version: 1, entity: &created})
+	s.work.put(location)
+	return nil
+}
 
-	delete(d.users, id)
-	return user
+func (s *locationShard) put(location *Location, replace bool) bool {
+	old, taken := s.work.locations.get(location.ID)
+	if !taken || replace {
+		location.Version = old.version + 1
+		s.work.put(location)
+	}
+	return taken
 }
 
-func (d *InmemoryDB) addLocation(location *Location) error {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+func (s *visitShard) publish() {
+	s.published.Store(&visitSnapshot{
+		visits:           s.work.visits.snapshot(),
+		visitsByUser:     s.work.visitsByUser.snapshot(),
+		visitsByLocation: s.work.visitsByLocation.snapshot(),
+	})
+}
+
+func (s *visitShard) load() *visitSnapshot {
+	return s.published.Load().(*visitSnapshot)
+}
+
+func (s *visitShard) unlock() {
+	s.events.release(&s.mux)
+}
 
-	if _, ok := d.locations[location.ID]; ok {
+func (s *visitShard) add(visit *Visit) error {
+	if s.work.visits.has(visit.ID) {
 		return errConflictID
 	}
-	d.locations[location.ID] = location
+	visit.Version = 1
+	created := *visit
+	s.history.record(visit.ID, revision{}, revision{version: 1, entity: &created})
+	s.work.insert(visit)
 	return nil
 }
 
-func (d *InmemoryDB) removeLocation(id int32) *Location {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+func (s *visitShard) put(visit *Visit, replace bool) bool {
+	old := s.work.get(visit.ID)
+	if old != nil && !replace {
+		return true
+	}
+	if old == nil {
+		visit.Version = 1
+		s.work.insert(visit)
+		return false
+	}
+	visit.Version = old.Version + 1
+	s.work.replace(old, visit)
+	return true
+}
 
-	var location *Location
-	location, ok := d.locations[id]
+func (s *userSnapshot) get(id int32) *User {
+	r, ok := s.users.get(id)
 	if !ok {
 		return nil
 	}
+	return &User{
+		ID:        r.id,
+		Email:     r.email,
+		FirstName: r.firstName,
+		LastName:  r.lastName,
+		Gender:    s.strings.get(r.gender),
+		BirthDate: r.birthDate,
+		Version:   r.version,
+	}
+}
 
-	delete(d.locations, id)
-	return location
+// put stores user, replacing the user with the same ID.
+func (s *userSnapshot) put(user *User) {
+	s.users.put(userRecord{
+		id:        user.ID,
+		version:   user.Version,
+		gender:    s.strings.intern(user.Gender),
+		birthDate: user.BirthDate,
+		email:     user.Email,
+		firstName: user.FirstName,
+		lastName:  user.LastName,
+	})
 }
 
-func (d *InmemoryDB) addVisit(visit *Visit) error {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+// admit interns the strings of user that a write from a client stores, or
+// fails if the string table cannot take them.
+func (s *userSnapshot) admit(user *User) error {
+	if !s.strings.reserve(user.Gender) {
+		return errInvalidField("gender", "has too many distinct values")
+	}
+	return nil
+}
 
-	if _, ok := d.visits[visit.ID]; ok {
-		return errConflictID
+func (s *locationSnapshot) get(id int32) *Location {
+	r, ok := s.locations.get(id)
+	if !ok {
+		return nil
 	}
-	d.visits[visit.ID] = visit
+	return &Location{
+		ID:       r.id,
+		Place:    r.place,
+		Country:  s.strings.get(r.country),
+		City:     s.strings.get(r.city),
+		Distance: r.distance,
+		Version:  r.version,
+	}
+}
 
-	d.visitsByUser.ReplaceOrInsert(VisitByUserItem{
-		userID:  visit.User,
-		visitID: visit.ID,
+func (s *locationSnapshot) put(location *Location) {
+	s.locations.put(locationRecord{
+		id:       location.ID,
+		version:  location.Version,
+		country:  s.strings.intern(location.Country),
+		city:     s.strings.intern(location.City),
+		distance: location.Distance,
+		place:    location.Place,
 	})
-	d.visitsByLocation.ReplaceOrInsert(VisitByLocationItem{
-		locationID: visit.Location,
-		visitID:    visit.ID,
+}
+
+// admit is the location counterpart of userSnapshot.admit.
+func (s *locationSnapshot) admit(location *Location) error {
+	if !s.strings.reserve(location.Country) {
+		return errInvalidField("country", "has too many distinct values")
+	}
+	if !s.strings.reserve(location.City) {
+		return errInvalidField("city", "has too many distinct values")
+	}
+	return nil
+}
+
+func (s *visitSnapshot) get(id int32) *Visit {
+	r, ok := s.visits.get(id)
+	if !ok {
+		return nil
+	}
+	return &Visit{
+		ID:        r.id,
+		Location:  r.location,
+		User:      r.user,
+		VisitedAt: r.visitedAt,
+		Mark:      r.mark,
+		Version:   r.version,
+	}
+}
+
+func (s *visitSnapshot) insert(visit *Visit) {
+	s.visits.put(visitRecord{
+		mark:      visit.Mark,
+		id:        visit.ID,
+		version:   visit.Version,
+		location:  visit.Location,
+		user:      visit.User,
+		visitedAt: visit.VisitedAt,
 	})
+	s.visitsByUser.add(visit.User, visit.ID)
+	s.visitsByLocation.add(visit.Location, visit.ID)
+}
+
+func (s *visitSnapshot) delete(visit *Visit) {
+	s.visitsByUser.remove(visit.User, visit.ID)
+	s.visitsByLocation.remove(visit.Location, visit.ID)
+	s.visits.delete(visit.ID)
+}
 
+// replace stores visit in place of old, the visit with the same ID. Only
+// the posting lists whose owner changed are rewritten.
+func (s *visitSnapshot) replace(old *Visit, visit *Visit) {
+	s.visits.put(visitRecord{
+		mark:      visit.Mark,
+		id:        visit.ID,
+		version:   visit.Version,
+		location:  visit.Location,
+		user:      visit.User,
+		visitedAt: visit.VisitedAt,
+	})
+	if old.User != visit.User {
+		s.visitsByUser.remove(old.User, old.ID)
+		s.visitsByUser.add(visit.User, visit.ID)
+	}
+	if old.Location != visit.Location {
+		s.visitsByLocation.remove(old.Location, old.ID)
+		s.visitsByLocation.add(visit.Location, visit.ID)
+	}
+}
+
+// findConflicts returns errConflictID for each ID that is taken or repeats
+// an earlier ID of the same batch, and whether there was none.
+func findConflicts(ids []int32, taken func(id int32) bool) ([]error, bool) {
+	errs := make([]error, len(ids))
+	seen := make(map[int32]struct{}, len(ids))
+	ok := true
+	for i, id := range ids {
+		if _, repeated := seen[id]; repeated || taken(id) {
+			errs[i] = errConflictID
+			ok = false
+		}
+		seen[id] = struct{}{}
+	}
+	return errs, ok
+}
+
+func (d *InmemoryDB) addUser(user *User) error {
+	d.users.mux.Lock()
+	defer d.users.unlock()
+
+	err := d.users.add(user)
+	if err != nil {
+		return err
+	}
+	d.users.publish()
+	d.users.events.emit(eventCreate, user.ID, user.Version, *user)
 	return nil
 }
 
-func (d *InmemoryDB) removeVisit(id int32) *Visit {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+// addUsers adds users under a single lock and publishes them once at the
+// end, which avoids copying B-tree nodes for every record of a bulk load.
+// The returned slice holds the error for each user, if any.
+func (d *InmemoryDB) addUsers(users []*User) []error {
+	d.users.mux.Lock()
+	defer d.users.unlock()
+
+	errs := make([]error, len(users))
+	for i, user := range users {
+		errs[i] = d.users.add(user)
+	}
+	d.users.publish()
+	for i, user := range users {
+		if errs[i] == nil {
+			d.users.events.emit(eventCreate, user.ID, user.Version, *user)
+		}
+	}
+	return errs
+}
 
-	var visit *Visit
-	visit, ok := d.visits[id]
+// loadUsers stores users for a data load under a single lock, like
+// addUsers. A user whose ID is taken replaces the stored one if replace is
+// set and is dropped otherwise. It returns how many IDs were taken.
+func (d *InmemoryDB) loadUsers(users []*User, replace bool) int {
+	d.users.mux.Lock()
+	defer d.users.mux.Unlock()
+
+	taken := 0
+	for _, user := range users {
+		if d.users.put(user, replace) {
+			taken++
+		}
+	}
+	d.users.publish()
+	return taken
+}
+
+// addUsersAtomic adds either all users or, if any ID is taken or repeated
+// within the batch or any user cannot be stored, none of them. It reports
+// whether the users were added and the error of each user, if any.
+func (d *InmemoryDB) addUsersAtomic(users []*User) ([]error, bool) {
+	d.users.mux.Lock()
+	defer d.users.unlock()
+
+	ids := make([]int32, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	errs, ok := findConflicts(ids, func(id int32) bool {
+		return d.users.work.get(id) != nil
+	})
 	if !ok {
+		return errs, false
+	}
+	for i, user := range users {
+		if errs[i] = d.users.work.admit(user); errs[i] != nil {
+			ok = false
+		}
+	}
+	if !ok {
+		return errs, false
+	}
+	for _, user := range users {
+		d.users.add(user)
+	}
+	d.users.publish()
+	for _, user := range users {
+		d.users.events.emit(eventCreate, user.ID, user.Version, *user)
+	}
+	return errs, true
+}
+
+func (d *InmemoryDB) removeUser(id int32) *User {
+	d.users.mux.Lock()
+	defer d.users.unlock()
+
+	user := d.users.work.get(id)
+	if user == nil {
 		return nil
 	}
 
-	d.visitsByUser.Delete(VisitByUserItem{
-		userID:  visit.User,
-		visitID: visit.ID,
+	d.users.history.record(id, revision{version: user.Version, entity: user}, revision{version: user.Version + 1})
+	d.users.work.users.delete(id)
+	d.users.publish()
+	d.users.events.emit(eventDelete, id, user.Version+1, nil)
+	return user
+}
+
+// updateUser applies update to a copy of the user and stores the copy, so
+// readers that already hold the old pointer never observe a partial write.
+// If ifMatch is set, the user is only updated if its current ETag matches,
+// checked under the same lock. updateUser returns errNotFound if the user
+// does not exist and errPreconditionFailed if ifMatch does not match.
+func (d *InmemoryDB) updateUser(id int32, update *UserUpdate, ifMatch string) (*User, error) {
+	d.users.mux.Lock()
+	defer d.users.unlock()
+
+	old := d.users.work.get(id)
+	if old == nil {
+		return nil, errNotFound
+	}
+	if err := checkIfMatch(ifMatch, d.etag(old.Version)); err != nil {
+		return nil, err
+	}
+
+	user := *old
+	user.Version++
+	if update.Email != nil {
+		user.Email = *update.Email
+	}
+	if update.FirstName != nil {
+		user.FirstName = *update.FirstName
+	}
+	if update.LastName != nil {
+		user.LastName = *update.LastName
+	}
+	if update.Gender != nil {
+		user.Gender = *update.Gender
+	}
+	if update.BirthDate != nil {
+		user.BirthDate = *update.BirthDate
+	}
+	if err := d.users.work.admit(&user); err != nil {
+		return nil, err
+	}
+	d.users.history.record(id, revision{version: old.Version, entity: old}, revision{version: user.Version, entity: &user})
+	d.users.work.put(&user)
+	d.users.publish()
+	d.users.events.emit(eventUpdate, id, user.Version, user)
+	return &user, nil
+}
+
+func (d *InmemoryDB) addLocation(location *Location) error {
+	d.locations.mux.Lock()
+	defer d.locations.unlock()
+
+	err := d.locations.add(location)
+	if err != nil {
+		return err
+	}
+	d.locations.publish()
+	d.locations.events.emit(eventCreate, location.ID, location.Version, *location)
+	return nil
+}
+
+// addLocations is the location counterpart of addUsers.
+func (d *InmemoryDB) addLocations(locations []*Location) []error {
+	d.locations.mux.Lock()
+	defer d.locations.unlock()
+
+	errs := make([]error, len(locations))
+	for i, location := range locations {
+		errs[i] = d.locations.add(location)
+	}
+	d.locations.publish()
+	for i, location := range locations {
+		if errs[i] == nil {
+			d.locations.events.emit(eventCreate, location.ID, location.Version, *location)
+		}
+	}
+	return errs
+}
+
+// loadLocations is the location counterpart of loadUsers.
+func (d *InmemoryDB) loadLocations(locations []*Location, replace bool) int {
+	d.locations.mux.Lock()
+	defer d.locations.mux.Unlock()
+
+	taken := 0
+	for _, location := range locations {
+		if d.locations.put(location, replace) {
+			taken++
+		}
+	}
+	d.locations.publish()
+	return taken
+}
+
+// addLocationsAtomic is the location counterpart of addUsersAtomic.
+func (d *InmemoryDB) addLocationsAtomic(locations []*Location) ([]error, bool) {
+	d.locations.mux.Lock()
+	defer d.locations.unlock()
+
+	ids := make([]int32, len(locations))
+	for i, location := range locations {
+		ids[i] = location.ID
+	}
+	errs, ok := findConflicts(ids, func(id int32) bool {
+		return d.locations.work.get(id) != nil
 	})
-	d.visitsByLocation.Delete(VisitByLocationItem{
-		locationID: visit.Location,
-		visitID:    visit.ID,
+	if !ok {
+		return errs, false
+	}
+	for i, location := range locations {
+		if errs[i] = d.locations.work.admit(location); errs[i] != nil {
+			ok = false
+		}
+	}
+	if !ok {
+		return errs, false
+	}
+	for _, location := range locations {
+		d.locations.add(location)
+	}
+	d.locations.publish()
+	for _, location := range locations {
+		d.locations.events.emit(eventCreate, location.ID, location.Version, *location)
+	}
+	return errs, true
+}
+
+func (d *InmemoryDB) removeLocation(id int32) *Location {
+	d.locations.mux.Lock()
+	defer d.locations.unlock()
+
+	location := d.locations.work.get(id)
+	if location == nil {
+		return nil
+	}
+
+	d.locations.history.record(id, revision{version: location.Version, entity: location}, revision{version: location.Version + 1})
+	d.locations.work.locations.delete(id)
+	d.locations.publish()
+	d.locations.events.emit(eventDelete, id, location.Version+1, nil)
+	return location
+}
+
+// updateLocation is the location counterpart of updateUser.
+func (d *InmemoryDB) updateLocation(id int32, update *LocationUpdate, ifMatch string) (*Location, error) {
+	d.locations.mux.Lock()
+	defer d.locations.unlock()
+
+	old := d.locations.work.get(id)
+	if old == nil {
+		return nil, errNotFound
+	}
+	if err := checkIfMatch(ifMatch, d.etag(old.Version)); err != nil {
+		return nil, err
+	}
+
+	location := *old
+	location.Version++
+	if update.Place != nil {
+		location.Place = *update.Place
+	}
+	if update.Country != nil {
+		location.Country = *update.Country
+	}
+	if update.City != nil {
+		location.City = *update.City
+	}
+	if update.Distance != nil {
+		location.Distance = *update.Distance
+	}
+	if err := d.locations.work.admit(&location); err != nil {
+		return nil, err
+	}
+	d.locations.history.record(id, revision{version: old.Version, entity: old}, revision{version: location.Version, entity: &location})
+	d.locations.work.put(&location)
+	d.locations.publish()
+	d.locations.events.emit(eventUpdate, id, location.Version, location)
+	return &location, nil
+}
+
+func (d *InmemoryDB) addVisit(visit *Visit) error {
+	d.visits.mux.Lock()
+	defer d.visits.unlock()
+
+	err := d.visits.add(visit)
+	if err != nil {
+		return err
+	}
+	d.visits.publish()
+	d.visits.events.emit(eventCreate, visit.ID, visit.Version, *visit)
+	return nil
+}
+
+// addVisits is the visit counterpart of addUsers.
+func (d *InmemoryDB) addVisits(visits []*Visit) []error {
+	d.visits.mux.Lock()
+	defer d.visits.unlock()
+
+	errs := make([]error, len(visits))
+	for i, visit := range visits {
+		errs[i] = d.visits.add(visit)
+	}
+	d.visits.publish()
+	for i, visit := range visits {
+		if errs[i] == nil {
+			d.visits.events.emit(eventCreate, visit.ID, visit.Version, *visit)
+		}
+	}
+	return errs
+}
+
+// loadVisits is the visit counterpart of loadUsers.
+func (d *InmemoryDB) loadVisits(visits []*Visit, replace bool) int {
+	d.visits.mux.Lock()
+	defer d.visits.mux.Unlock()
+
+	taken := 0
+	for _, visit := range visits {
+		if d.visits.put(visit, replace) {
+			taken++
+		}
+	}
+	d.visits.publish()
+	return taken
+}
+
+// addVisitsAtomic is the visit counterpart of addUsersAtomic.
+func (d *InmemoryDB) addVisitsAtomic(visits []*Visit) ([]error, bool) {
+	d.visits.mux.Lock()
+	defer d.visits.unlock()
+
+	ids := make([]int32, len(visits))
+	for i, visit := range visits {
+		ids[i] = visit.ID
+	}
+	errs, ok := findConflicts(ids, func(id int32) bool {
+		return d.visits.work.get(id) != nil
 	})
+	if !ok {
+		return errs, false
+	}
+	for _, visit := range visits {
+		d.visits.add(visit)
+	}
+	d.visits.publish()
+	for _, visit := range visits {
+		d.visits.events.emit(eventCreate, visit.ID, visit.Version, *visit)
+	}
+	return errs, true
+}
+
+func (d *InmemoryDB) removeVisit(id int32) *Visit {
+	d.visits.mux.Lock()
+	defer d.visits.unlock()
+
+	visit := d.visits.work.get(id)
+	if visit == nil {
+		return nil
+	}
 
-	delete(d.visits, id)
+	d.visits.history.record(id, revision{version: visit.Version, entity: visit}, revision{version: visit.Version + 1})
+	d.visits.work.delete(visit)
+	d.visits.publish()
+	d.visits.events.emit(eventDelete, id, visit.Version+1, nil)
 	return visit
 }
 
-func (d *InmemoryDB) getUser(id int32) *User {
-	d.mux.RLock()
-	defer d.mux.RUnlock()
+// updateVisit is the visit counterpart of updateUser. The indexes are
+// rewritten before the next snapshot is published, so queries never see a
+// visit that is missing from visitsByUser or visitsByLocation.
+func (d *InmemoryDB) updateVisit(id int32, update *VisitUpdate, ifMatch string) (*Visit, error) {
+	d.visits.mux.Lock()
+	defer d.visits.unlock()
+
+	old := d.visits.work.get(id)
+	if old == nil {
+		return nil, errNotFound
+	}
+	if err := checkIfMatch(ifMatch, d.etag(old.Version)); err != nil {
+		return nil, err
+	}
 
-	return d.users[id]
+	visit := *old
+	visit.Version++
+	if update.Location != nil {
+		visit.Location = *update.Location
+	}
+	if update.User != nil {
+		visit.User = *update.User
+	}
+	if update.VisitedAt != nil {
+		visit.VisitedAt = *update.VisitedAt
+	}
+	if update.Mark != nil {
+		visit.Mark = *update.Mark
+	}
+	d.visits.history.record(id, revision{version: old.Version, entity: old}, revision{version: visit.Version, entity: &visit})
+	d.visits.work.replace(old, &visit)
+	d.visits.publish()
+	d.visits.events.emit(eventUpdate, id, visit.Version, visit)
+	return &visit, nil
 }
 
-func (d *InmemoryDB) getLocation(id int32) *Location {
-	d.mux.RLock()
-	defer d.mux.RUnlock()
+// putUser stores user in place of the user with the same ID, creating it
+// if there is none, and reports whether it was created. ifMatch and
+// ifNoneMatch are the preconditions of the request, checked under the
+// same lock as the write.
+func (d *InmemoryDB) putUser(user *User, ifMatch string, ifNoneMatch string) (bool, error) {
+	d.users.mux.Lock()
+	defer d.users.unlock()
+
+	old := d.users.work.get(user.ID)
+	etag := ""
+	if old != nil {
+		etag = d.etag(old.Version)
+	}
+	if err := checkPreconditions(old != nil, etag, ifMatch, ifNoneMatch); err != nil {
+		return false, err
+	}
 
-	return d.locations[id]
+	if old == nil {
+		if err := d.users.add(user); err != nil {
+			return false, err
+		}
+		d.users.publish()
+		d.users.events.emit(eventCreate, user.ID, user.Version, *user)
+		return true, nil
+	}
+	if err := d.users.work.admit(user); err != nil {
+		return false, err
+	}
+	user.Version = old.Version + 1
+	d.users.history.record(user.ID, revision{version: old.Version, entity: old}, revision{version: user.Version, entity: user})
+	d.users.work.put(user)
+	d.users.publish()
+	d.users.events.emit(eventUpdate, user.ID, user.Version, *user)
+	return false, nil
 }
 
-func (d *InmemoryDB) getVisit(id int32) *Visit {
-	d.mux.RLock()
-	defer d.mux.RUnlock()
+// putLocation is the location counterpart of putUser.
+func (d *InmemoryDB) putLocation(location *Location, ifMatch string, ifNoneMatch string) (bool, error) {
+	d.locations.mux.Lock()
+	defer d.locations.unlock()
+
+	old := d.locations.work.get(location.ID)
+	etag := ""
+	if old != nil {
+		etag = d.etag(old.Version)
+	}
+	if err := checkPreconditions(old != nil, etag, ifMatch, ifNoneMatch); err != nil {
+		return false, err
+	}
+
+	if old == nil {
+		if err := d.locations.add(location); err != nil {
+			return false, err
+		}
+		d.locations.publish()
+		d.locations.events.emit(eventCreate, location.ID, location.Version, *location)
+		return true, nil
+	}
+	if err := d.locations.work.admit(location); err != nil {
+		return false, err
+	}
+	location.Version = old.Version + 1
+	d.locations.history.record(location.ID, revision{version: old.Version, entity: old}, revision{version: location.Version, entity: location})
+	d.locations.work.put(location)
+	d.locations.publish()
+	d.locations.events.emit(eventUpdate, location.ID, location.Version, *location)
+	return false, nil
+}
+
+// putVisit is the visit counterpart of putUser. Like updateVisit, it
+// rewrites the indexes before the next snapshot is published.
+func (d *InmemoryDB) putVisit(visit *Visit, ifMatch string, ifNoneMatch string) (bool, error) {
+	d.visits.mux.Lock()
+	defer d.visits.unlock()
+
+	old := d.visits.work.get(visit.ID)
+	etag := ""
+	if old != nil {
+		etag = d.etag(old.Version)
+	}
+	if err := checkPreconditions(old != nil, etag, ifMatch, ifNoneMatch); err != nil {
+		return false, err
+	}
+
+	if old == nil {
+		d.visits.add(visit)
+		d.visits.publish()
+		d.visits.events.emit(eventCreate, visit.ID, visit.Version, *visit)
+		return true, nil
+	}
+	visit.Version = old.Version + 1
+	d.visits.history.record(visit.ID, revision{version: old.Version, entity: old}, revision{version: visit.Version, entity: visit})
+	d.visits.work.replace(old, visit)
+	d.visits.publish()
+	d.visits.events.emit(eventUpdate, visit.ID, visit.Version, *visit)
+	return false, nil
+}
 
-	return d.visits[id]
+func (d *InmemoryDB) getUser(id int32) *User {
+	return d.users.load().get(id)
+}
+
+func (d *InmemoryDB) getLocation(id int32) *Location {
+	return d.locations.load().get(id)
+}
+
+func (d *InmemoryDB) getVisit(id int32) *Visit {
+	return d.visits.load().get(id)
 }
 
 type visitsByTime []VisitPlace
@@ -306,43 +1154,48 @@ func (a visitsByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a visitsByTime) Less(i, j int) bool { return a[i].VisitedAt < a[j].VisitedAt }
 
 func (d *InmemoryDB) queryVisits(userID int32, fromDate int64, toDate int64, country string, toDistance int64) []VisitPlace {
-	d.mux.RLock()
-	defer d.mux.RUnlock()
+	// Load visits first, so a location written before a visit that refers
+	// to it is in the later snapshot. That is not guaranteed: visits are
+	// not checked against the locations when they are written or
+	// re-pointed, and locations can be removed. Such visits are skipped.
+	visitSnap := d.visits.load()
+	locationSnap := d.locations.load()
 
 	visits := make([]VisitPlace, 0)
 
-	lb := VisitByUserItem{
-		userID:  userID,
-		visitID: math.MinInt32,
-	}
-	ub := VisitByUserItem{
-		userID:  userID,
-		visitID: math.MaxInt32,
+	// A country that was never stored matches no location.
+	countryID, ok := d.strings.lookup(country)
+	if len(country) != 0 && !ok {
+		return visits
 	}
-	db.visitsByUser.AscendRange(lb, ub, func(item btree.Item) bool {
-		visitID := item.(VisitByUserItem).visitID
-		v := db.getVisit(visitID)
-		if fromDate >= v.VisitedAt {
-			return true
+
+	for _, visitID := range visitSnap.visitsByUser.get(userID) {
+		v, _ := visitSnap.visits.get(visitID)
+		if fromDate >= v.visitedAt {
+			continue
+		}
+		if toDate <= v.visitedAt {
+			continue
 		}
-		if toDate <= v.VisitedAt {
-			return true
+		// A visit may refer to a location the data never had, depending
+		// on the load policy.
+		location, ok := locationSnap.locations.get(v.location)
+		if !ok {
+			continue
 		}
-		location := db.getLocation(v.Location)
-		if len(country) != 0 && country != location.Country {
-			return true
+		if len(country) != 0 && countryID != location.country {
+			continue
 		}
-		if toDistance <= location.Distance {
-			return true
+		if toDistance <= location.distance {
+			continue
 		}
 		visit := VisitPlace{
-			Mark:      v.Mark,
-			VisitedAt: v.VisitedAt,
-			Place:     location.Place,
+			Mark:      v.mark,
+			VisitedAt: v.visitedAt,
+			Place:     location.place,
 		}
 		visits = append(visits, visit)
-		return true
-	})
+	}
 
 	sort.Sort(visitsByTime(visits))
 
@@ -350,12 +1203,7 @@ func (d *InmemoryDB) queryVisits(userID int32, fromDate int64, toDate int64, cou
 }
 
 // TODO: int64 is too large for ages
-func computeAge(birth int64) int64 {
-
-	// It seems `now` is computed when generating data
-	// Commit time https://github.com/MailRuChamps/hlcupdocs/commit/5dd3cd07200ae97a5badd242bf891aad3fed6e5b
-	now := time.Date(2018, 12, 15, 20, 33, 0, 0, time.UTC)
-
+func computeAge(birth int64, now time.Time) int64 {
 	birthTime := time.Unix(birth, 0)
 	years := now.Year() - birthTime.Year()
 	if now.Month() < birthTime.Month() ||
@@ -366,48 +1214,46 @@ func computeAge(birth int64) int64 {
 }
 
 func (d *InmemoryDB) queryAverage(locationID int32, fromDate int64, toDate int64, fromAge int64, toAge int64, gender string) float64 {
-	d.mux.RLock()
-	defer d.mux.RUnlock()
+	visitSnap := d.visits.load()
+	userSnap := d.users.load()
+
+	genderID, ok := d.strings.lookup(gender)
+	if len(gender) != 0 && !ok {
+		return 0
+	}
 
 	count := int64(0)
 	sum := int64(0)
 
-	lb := VisitByLocationItem{
-		locationID: locationID,
-		visitID:    math.MinInt32,
-	}
-	ub := VisitByLocationItem{
-		locationID: locationID,
-		visitID:    math.MaxInt32,
-	}
-	db.visitsByLocation.AscendRange(lb, ub, func(item btree.Item) bool {
-		visitID := item.(VisitByLocationItem).visitID
-		v := db.getVisit(visitID)
+	for _, visitID := range visitSnap.visitsByLocation.get(locationID) {
+		v, _ := visitSnap.visits.get(visitID)
 
-		if fromDate >= v.VisitedAt {
-			return true
+		if fromDate >= v.visitedAt {
+			continue
 		}
-		if toDate <= v.VisitedAt {
-			return true
+		if toDate <= v.visitedAt {
+			continue
+		}
+		user, ok := userSnap.users.get(v.user)
+		if !ok {
+			continue
 		}
-		user := db.getUser(v.User)
 
-		if len(gender) != 0 && gender != user.Gender {
-			return true
+		if len(gender) != 0 && genderID != user.gender {
+			continue
 		}
 
-		age := computeAge(user.BirthDate)
+		age := computeAge(user.birthDate, d.ageReference)
 		if fromAge > age {
-			return true
+			continue
 		}
 		if toAge <= age {
-			return true
+			continue
 		}
 
 		count++
-		sum += int64(v.Mark)
-		return true
-	})
+		sum += int64(v.mark)
+	}
 
 	if count == 0 {
 		return 0
@@ -415,65 +1261,10 @@ func (d *InmemoryDB) queryAverage(locationID int32, fromDate int64, toDate int64
 	return float64(sum) / float64(count)
 }
 
-func unmarshalFromFile(f *zip.File, v interface{}) error {
-	rc, err := f.Open()
-	if err != nil {
-		return err
-	}
-	bs, err := ioutil.ReadAll(rc)
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(bs, v)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func initializeData(dataDir string) error {
-	zipPath := fmt.Sprintf("%s/data.zip", dataDir)
-	r, err := zip.OpenReader(zipPath)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-
-	for _, f := range r.File {
-		log.Println("Loading", f.Name)
-		if strings.HasPrefix(f.Name, "users") {
-			var users Users
-			err := unmarshalFromFile(f, &users)
-			if err != nil {
-				return err
-			}
-			for _, u := range users.Users {
-				db.addUser(u)
-			}
-		}
-		if strings.HasPrefix(f.Name, "locations") {
-			var locations Locations
-			err := unmarshalFromFile(f, &locations)
-			if err != nil {
-				return err
-			}
-			for _, l := range locations.Locations {
-				db.addLocation(l)
-			}
-		}
-		if strings.HasPrefix(f.Name, "visits") {
-			var visits Visits
-			err := unmarshalFromFile(f, &visits)
-			if err != nil {
-				return err
-			}
-			for _, v := range visits.Visits {
-				db.addVisit(v)
-			}
-		}
-	}
-
-	return nil
+// roundDigits rounds x to the given number of decimal digits.
+func roundDigits(x float64, digits int) float64 {
+	scale := math.Pow(10, float64(digits))
+	return math.Round(x*scale) / scale
 }
 
 func parseInt32(s string) (int32, error) {
@@ -495,100 +1286,181 @@ func parseInt64OrDefault(s string, d int64) (int64, error) {
 	return int64(id), nil
 }
 
-func getUserHandler(w http.ResponseWriter, r *http.Request) {
+func (a *api) getUserHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := parseInt32(vars["id"])
 	if err != nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
 		return
 	}
-	user := db.getUser(id)
+	asOf, past, err := parseAsOf(r)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	db := currentDB()
+	var user *User
+	if past {
+		user, err = db.getUserAsOf(id, asOf)
+		if err != nil {
+			a.writeError(w, r, err)
+			return
+		}
+	} else {
+		user = db.getUser(id)
+	}
 	if user == nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
+		return
+	}
+	// Past states are not cached: they have the version of their time.
+	if !past && notModified(w, r, db.etag(user.Version)) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Transfer-Encoding", "identity")
 	err = json.NewEncoder(w).Encode(user)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r, "encode response", err)
 	}
 }
 
-func getLocationHandler(w http.ResponseWriter, r *http.Request) {
+func (a *api) getLocationHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := parseInt32(vars["id"])
 	if err != nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
 		return
 	}
-	location := db.getLocation(id)
+	asOf, past, err := parseAsOf(r)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	db := currentDB()
+	var location *Location
+	if past {
+		location, err = db.getLocationAsOf(id, asOf)
+		if err != nil {
+			a.writeError(w, r, err)
+			return
+		}
+	} else {
+		location = db.getLocation(id)
+	}
 	if location == nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
+		return
+	}
+	// Past states are not cached: they have the version of their time.
+	if !past && notModified(w, r, db.etag(location.Version)) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Transfer-Encoding", "identity")
 	err = json.NewEncoder(w).Encode(location)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r, "encode response", err)
 	}
 }
 
-func getVisitHandler(w http.ResponseWriter, r *http.Request) {
+func (a *api) getVisitHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := parseInt32(vars["id"])
 	if err != nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
+		return
+	}
+	asOf, past, err := parseAsOf(r)
+	if err != nil {
+		a.writeError(w, r, err)
 		return
 	}
-	visit := db.getVisit(id)
+	db := currentDB()
+	var visit *Visit
+	if past {
+		visit, err = db.getVisitAsOf(id, asOf)
+		if err != nil {
+			a.writeError(w, r, err)
+			return
+		}
+	} else {
+		visit = db.getVisit(id)
+	}
 	if visit == nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
+		return
+	}
+	// Past states are not cached: they have the version of their time.
+	if !past && notModified(w, r, db.etag(visit.Version)) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Transfer-Encoding", "identity")
 	err = json.NewEncoder(w).Encode(visit)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r, "encode response", err)
 	}
 }
 
-func getUserVisitsHandler(w http.ResponseWriter, r *http.Request) {
+func (a *api) getUserVisitsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	userID, err := parseInt32(vars["userID"])
 	if err != nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
 		return
 	}
 
-	user := db.getUser(userID)
+	asOf, past, err := parseAsOf(r)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	db := currentDB()
+	var user *User
+	if past {
+		user, err = db.getUserAsOf(userID, asOf)
+		if err != nil {
+			a.writeError(w, r, err)
+			return
+		}
+	} else {
+		user = db.getUser(userID)
+	}
 	if user == nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
 		return
 	}
 
 	query := r.URL.Query()
 	fromDate, err := parseInt64OrDefault(query.Get("fromDate"), math.MinInt64)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidField("fromDate", "must be an integer"))
 		return
 	}
 	toDate, err := parseInt64OrDefault(query.Get("toDate"), math.MaxInt64)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidField("toDate", "must be an integer"))
 		return
 	}
 	country := query.Get("country")
 	toDistance, err := parseInt64OrDefault(query.Get("toDistance"), math.MaxInt64)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidField("toDistance", "must be an integer"))
 		return
 	}
 
-	visits := db.queryVisits(userID, fromDate, toDate, country, toDistance)
+	var visits []VisitPlace
+	if past {
+		visits, err = db.queryVisitsAsOf(userID, asOf, fromDate, toDate, country, toDistance)
+		if err != nil {
+			a.writeError(w, r, err)
+			return
+		}
+	} else {
+		visits = db.queryVisits(userID, fromDate, toDate, country, toDistance)
+	}
 
 	response := struct {
 		Visits []VisitPlace `json:"visits"`
@@ -599,93 +1471,115 @@ func getUserVisitsHandler(w http.ResponseWriter, r *http.Request) {
 
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r, "encode response", err)
 	}
 }
 
-func getLocationAverageHandler(w http.ResponseWriter, r *http.Request) {
+func (a *api) getLocationAverageHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	locationID, err := parseInt32(vars["locationID"])
 	if err != nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
 		return
 	}
 
-	location := db.getLocation(locationID)
+	asOf, past, err := parseAsOf(r)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	db := currentDB()
+	var location *Location
+	if past {
+		location, err = db.getLocationAsOf(locationID, asOf)
+		if err != nil {
+			a.writeError(w, r, err)
+			return
+		}
+	} else {
+		location = db.getLocation(locationID)
+	}
 	if location == nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
 		return
 	}
 
 	query := r.URL.Query()
 	fromDate, err := parseInt64OrDefault(query.Get("fromDate"), math.MinInt64)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidField("fromDate", "must be an integer"))
 		return
 	}
 	toDate, err := parseInt64OrDefault(query.Get("toDate"), math.MaxInt64)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidField("toDate", "must be an integer"))
 		return
 	}
 	fromAge, err := parseInt64OrDefault(query.Get("fromAge"), math.MinInt64)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidField("fromAge", "must be an integer"))
 		return
 	}
 	toAge, err := parseInt64OrDefault(query.Get("toAge"), math.MaxInt64)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidField("toAge", "must be an integer"))
 		return
 	}
 	gender := query.Get("gender")
 	if len(gender) > 1 {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidField("gender", "must be a single letter"))
 		return
 	}
 
-	average := db.queryAverage(locationID, fromDate, toDate, fromAge, toAge, gender)
-	average5Digit := math.Round(average*100000) / 100000
-
+	var average float64
+	if past {
+		average, err = db.queryAverageAsOf(locationID, asOf, fromDate, toDate, fromAge, toAge, gender)
+		if err != nil {
+			a.writeError(w, r, err)
+			return
+		}
+	} else {
+		average = db.queryAverage(locationID, fromDate, toDate, fromAge, toAge, gender)
+	}
 	response := struct {
 		Avg float64 `json:"avg"`
-	}{Avg: average5Digit}
+	}{Avg: roundDigits(average, a.config.AverageDigits)}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Transfer-Encoding", "identity")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r, "encode response", err)
 	}
 }
 
-func updateUserHandler(w http.ResponseWriter, r *http.Request) {
+func (a *api) updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	userID, err := parseInt32(vars["id"])
 	if err != nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
 		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Bad Request", 400)
+		logClientError(r, "read body", err)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
 
 	var d map[string]interface{}
 	err = json.Unmarshal(body, &d)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Bad Request", 400)
+		logClientError(r, "decode body", err)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
-	for _, v := range d {
+	for k, v := range d {
 		if v == nil {
-			http.Error(w, "Bad Request", 400)
+			a.writeError(w, r, errNullField(k))
 			return
 		}
 	}
@@ -693,70 +1587,51 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	var userUpdate UserUpdate
 	err = json.Unmarshal(body, &userUpdate)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
 
-	user := db.removeUser(userID)
-	if user == nil {
-		http.NotFound(w, r)
-		return
-	}
-	if userUpdate.Email != nil {
-		user.Email = *userUpdate.Email
-	}
-	if userUpdate.FirstName != nil {
-		user.FirstName = *userUpdate.FirstName
-	}
-	if userUpdate.LastName != nil {
-		user.LastName = *userUpdate.LastName
-	}
-	if userUpdate.Gender != nil {
-		user.Gender = *userUpdate.Gender
-	}
-	if userUpdate.BirthDate != nil {
-		user.BirthDate = *userUpdate.BirthDate
-	}
-
-	err = db.addUser(user)
+	db := currentDB()
+	user, err := db.updateUser(userID, &userUpdate, headerList(r, "If-Match"))
 	if err != nil {
-		log.Println("unreachable error", err)
-		http.Error(w, "Server Error", 500)
+		a.writeError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", db.etag(user.Version))
+
 	_, err = w.Write([]byte("{}"))
 	if err != nil {
-		log.Println(err)
+		logRequestError(r, "write response", err)
 	}
 }
 
-func updateLocationHandler(w http.ResponseWriter, r *http.Request) {
+func (a *api) updateLocationHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	locationID, err := parseInt32(vars["id"])
 	if err != nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
 		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Bad Request", 400)
+		logClientError(r, "read body", err)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
 
 	var d map[string]interface{}
 	err = json.Unmarshal(body, &d)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Bad Request", 400)
+		logClientError(r, "decode body", err)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
-	for _, v := range d {
+	for k, v := range d {
 		if v == nil {
-			http.Error(w, "Bad Request", 400)
+			a.writeError(w, r, errNullField(k))
 			return
 		}
 	}
@@ -764,68 +1639,51 @@ func updateLocationHandler(w http.ResponseWriter, r *http.Request) {
 	var locationUpdate LocationUpdate
 	err = json.Unmarshal(body, &locationUpdate)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
-		return
-	}
-
-	location := db.removeLocation(locationID)
-	if location == nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
 
-	if locationUpdate.Place != nil {
-		location.Place = *locationUpdate.Place
-	}
-	if locationUpdate.Country != nil {
-		location.Country = *locationUpdate.Country
-	}
-	if locationUpdate.City != nil {
-		location.City = *locationUpdate.City
-	}
-	if locationUpdate.Distance != nil {
-		location.Distance = *locationUpdate.Distance
-	}
-
-	err = db.addLocation(location)
+	db := currentDB()
+	location, err := db.updateLocation(locationID, &locationUpdate, headerList(r, "If-Match"))
 	if err != nil {
-		log.Println("unreachable error", err)
-		http.Error(w, "Server Error", 500)
+		a.writeError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", db.etag(location.Version))
+
 	_, err = w.Write([]byte("{}"))
 	if err != nil {
-		log.Println(err)
+		logRequestError(r, "write response", err)
 	}
 }
 
-func updateVisitHandler(w http.ResponseWriter, r *http.Request) {
+func (a *api) updateVisitHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	visitID, err := parseInt32(vars["id"])
 	if err != nil {
-		http.NotFound(w, r)
+		a.writeError(w, r, errNotFound)
 		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Bad Request", 400)
+		logClientError(r, "read body", err)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
 
 	var d map[string]interface{}
 	err = json.Unmarshal(body, &d)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Bad Request", 400)
+		logClientError(r, "decode body", err)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
-	for _, v := range d {
+	for k, v := range d {
 		if v == nil {
-			http.Error(w, "Bad Request", 400)
+			a.writeError(w, r, errNullField(k))
 			return
 		}
 	}
@@ -833,221 +1691,356 @@ func updateVisitHandler(w http.ResponseWriter, r *http.Request) {
 	var visitUpdate VisitUpdate
 	err = json.Unmarshal(body, &visitUpdate)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
 
-	visit := db.removeVisit(visitID)
-	if visit == nil {
-		http.NotFound(w, r)
+	db := currentDB()
+	visit, err := db.updateVisit(visitID, &visitUpdate, headerList(r, "If-Match"))
+	if err != nil {
+		a.writeError(w, r, err)
 		return
 	}
 
-	if visitUpdate.Location != nil {
-		visit.Location = *visitUpdate.Location
+	w.Header().Set("ETag", db.etag(visit.Version))
+
+	_, err = w.Write([]byte("{}"))
+	if err != nil {
+		logRequestError(r, "write response", err)
 	}
-	if visitUpdate.User != nil {
-		visit.User = *visitUpdate.User
+}
+
+// putUserHandler replaces or creates the user with the ID of the path. The
+// body is a complete user, as for /users/new; its id may be left out.
+func (a *api) putUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseInt32(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeError(w, r, errNotFound)
+		return
+	}
+
+	var newUser NewUser
+	err = json.NewDecoder(r.Body).Decode(&newUser)
+	if err != nil {
+		a.writeError(w, r, errInvalidBody(err))
+		return
 	}
-	if visitUpdate.VisitedAt != nil {
-		visit.VisitedAt = *visitUpdate.VisitedAt
+	if newUser.ID == nil {
+		newUser.ID = &id
+	} else if *newUser.ID != id {
+		a.writeError(w, r, errInvalidField("id", "must match the id in the path"))
+		return
 	}
-	if visitUpdate.Mark != nil {
-		visit.Mark = *visitUpdate.Mark
+	err = newUser.validate()
+	if err != nil {
+		a.writeError(w, r, err)
+		return
 	}
 
-	err = db.addVisit(visit)
+	db := currentDB()
+	user := newUser.user()
+	created, err := db.putUser(user, headerList(r, "If-Match"), headerList(r, "If-None-Match"))
 	if err != nil {
-		log.Println("unreachable error", err)
-		http.Error(w, "Server Error", 500)
+		a.writeError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", db.etag(user.Version))
+	if created {
+		w.Header().Set("Location", "/users/"+strconv.Itoa(int(user.ID)))
+		w.WriteHeader(http.StatusCreated)
+	}
 	_, err = w.Write([]byte("{}"))
 	if err != nil {
-		log.Println(err)
+		logRequestError(r, "write response", err)
 	}
 }
 
-func newUserHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
-	var newUser NewUser
-	err := decoder.Decode(&newUser)
+// putLocationHandler replaces or creates the location with the ID of the path. The
+// body is a complete location, as for /locations/new; its id may be left out.
+func (a *api) putLocationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseInt32(mux.Vars(r)["id"])
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errNotFound)
 		return
 	}
-	if newUser.ID == nil {
-		http.Error(w, "Bad Request", 400)
+
+	var newLocation NewLocation
+	err = json.NewDecoder(r.Body).Decode(&newLocation)
+	if err != nil {
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
-	if newUser.Email == nil {
-		http.Error(w, "Bad Request", 400)
+	if newLocation.ID == nil {
+		newLocation.ID = &id
+	} else if *newLocation.ID != id {
+		a.writeError(w, r, errInvalidField("id", "must match the id in the path"))
 		return
 	}
-	if newUser.FirstName == nil {
-		http.Error(w, "Bad Request", 400)
+	err = newLocation.validate()
+	if err != nil {
+		a.writeError(w, r, err)
 		return
 	}
-	if newUser.LastName == nil {
-		http.Error(w, "Bad Request", 400)
+
+	db := currentDB()
+	location := newLocation.location()
+	created, err := db.putLocation(location, headerList(r, "If-Match"), headerList(r, "If-None-Match"))
+	if err != nil {
+		a.writeError(w, r, err)
 		return
 	}
-	if newUser.Gender == nil {
-		http.Error(w, "Bad Request", 400)
-		return
+
+	w.Header().Set("ETag", db.etag(location.Version))
+	if created {
+		w.Header().Set("Location", "/locations/"+strconv.Itoa(int(location.ID)))
+		w.WriteHeader(http.StatusCreated)
+	}
+	_, err = w.Write([]byte("{}"))
+	if err != nil {
+		logRequestError(r, "write response", err)
 	}
-	if newUser.BirthDate == nil {
-		http.Error(w, "Bad Request", 400)
+}
+
+// putVisitHandler replaces or creates the visit with the ID of the path. The
+// body is a complete visit, as for /visits/new; its id may be left out.
+func (a *api) putVisitHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseInt32(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeError(w, r, errNotFound)
 		return
 	}
 
-	user := User{
-		ID:        *newUser.ID,
-		Email:     *newUser.Email,
-		FirstName: *newUser.FirstName,
-		LastName:  *newUser.LastName,
-		Gender:    *newUser.Gender,
-		BirthDate: *newUser.BirthDate,
+	var newVisit NewVisit
+	err = json.NewDecoder(r.Body).Decode(&newVisit)
+	if err != nil {
+		a.writeError(w, r, errInvalidBody(err))
+		return
+	}
+	if newVisit.ID == nil {
+		newVisit.ID = &id
+	} else if *newVisit.ID != id {
+		a.writeError(w, r, errInvalidField("id", "must match the id in the path"))
+		return
+	}
+	err = newVisit.validate()
+	if err != nil {
+		a.writeError(w, r, err)
+		return
 	}
 
-	err = db.addUser(&user)
+	db := currentDB()
+	visit := newVisit.visit()
+	created, err := db.putVisit(visit, headerList(r, "If-Match"), headerList(r, "If-None-Match"))
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", db.etag(visit.Version))
+	if created {
+		w.Header().Set("Location", "/visits/"+strconv.Itoa(int(visit.ID)))
+		w.WriteHeader(http.StatusCreated)
+	}
 	_, err = w.Write([]byte("{}"))
 	if err != nil {
-		log.Println(err)
+		logRequestError(r, "write response", err)
 	}
 }
 
-func newLocationHandler(w http.ResponseWriter, r *http.Request) {
+func (a *api) newUserHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	var newLocation NewLocation
-	err := decoder.Decode(&newLocation)
+	var newUser NewUser
+	err := decoder.Decode(&newUser)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
-
-	if newLocation.ID == nil {
-		http.Error(w, "Bad Request", 400)
+	err = newUser.validate()
+	if err != nil {
+		a.writeError(w, r, err)
 		return
 	}
-	if newLocation.Place == nil {
-		http.Error(w, "Bad Request", 400)
+
+	err = currentDB().addUser(newUser.user())
+	if err != nil {
+		a.writeError(w, r, err)
 		return
 	}
-	if newLocation.Country == nil {
-		http.Error(w, "Bad Request", 400)
-		return
+
+	_, err = w.Write([]byte("{}"))
+	if err != nil {
+		logRequestError(r, "write response", err)
 	}
-	if newLocation.City == nil {
-		http.Error(w, "Bad Request", 400)
+}
+
+func (a *api) newLocationHandler(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var newLocation NewLocation
+	err := decoder.Decode(&newLocation)
+	if err != nil {
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
-	if newLocation.Distance == nil {
-		http.Error(w, "Bad Request", 400)
+	err = newLocation.validate()
+	if err != nil {
+		a.writeError(w, r, err)
 		return
 	}
 
-	location := Location{
-		ID:       *newLocation.ID,
-		Place:    *newLocation.Place,
-		Country:  *newLocation.Country,
-		City:     *newLocation.City,
-		Distance: *newLocation.Distance,
-	}
-
-	err = db.addLocation(&location)
+	err = currentDB().addLocation(newLocation.location())
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, err)
 		return
 	}
 
 	_, err = w.Write([]byte("{}"))
 	if err != nil {
-		log.Println(err)
+		logRequestError(r, "write response", err)
 	}
 }
 
-func newVisitHandler(w http.ResponseWriter, r *http.Request) {
+func (a *api) newVisitHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var newVisit NewVisit
 	err := decoder.Decode(&newVisit)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		a.writeError(w, r, errInvalidBody(err))
 		return
 	}
-	if newVisit.ID == nil {
-		http.Error(w, "Bad Request", 400)
+	err = newVisit.validate()
+	if err != nil {
+		a.writeError(w, r, err)
 		return
 	}
-	if newVisit.Location == nil {
-		http.Error(w, "Bad Request", 400)
+
+	err = currentDB().addVisit(newVisit.visit())
+	if err != nil {
+		a.writeError(w, r, err)
 		return
 	}
-	if newVisit.User == nil {
-		http.Error(w, "Bad Request", 400)
-		return
+
+	_, err = w.Write([]byte("{}"))
+	if err != nil {
+		logRequestError(r, "write response", err)
 	}
-	if newVisit.VisitedAt == nil {
-		http.Error(w, "Bad Request", 400)
-		return
+}
+
+// route is an API endpoint. Both server engines dispatch from this table,
+// so they always agree on routing.
+type route struct {
+	method   string
+	template string
+	handler  http.HandlerFunc
+}
+
+// api serves the routes with the configuration it was built with. Handlers
+// and middlewares are its methods, so they read the settings from it rather
+// than from a package variable.
+type api struct {
+	config Config
+}
+
+func newAPI(config Config) *api {
+	return &api{config: config}
+}
+
+// routes returns the endpoints of a. They are matched in order, so the
+// /new and /batch endpoints must come before the /{id} ones.
+func (a *api) routes() []route {
+	return []route{
+		{"GET", "/users/{id}", a.getUserHandler},
+		{"GET", "/locations/{id}", a.getLocationHandler},
+		{"GET", "/visits/{id}", a.getVisitHandler},
+		{"GET", "/users/{userID}/visits", a.getUserVisitsHandler},
+		{"GET", "/locations/{locationID}/avg", a.getLocationAverageHandler},
+		{"POST", "/users/new", a.idempotent(a.newUserHandler)},
+		{"POST", "/locations/new", a.idempotent(a.newLocationHandler)},
+		{"POST", "/visits/new", a.idempotent(a.newVisitHandler)},
+		{"POST", "/users/batch", a.batchUsersHandler},
+		{"POST", "/locations/batch", a.batchLocationsHandler},
+		{"POST", "/visits/batch", a.batchVisitsHandler},
+		{"POST", "/users/{id}", a.updateUserHandler},
+		{"POST", "/locations/{id}", a.updateLocationHandler},
+		{"POST", "/visits/{id}", a.updateVisitHandler},
+		{"PUT", "/users/{id}", a.putUserHandler},
+		{"PUT", "/locations/{id}", a.putLocationHandler},
+		{"PUT", "/visits/{id}", a.putVisitHandler},
+		{"PATCH", "/users/{id}", a.patchUserHandler},
+		{"PATCH", "/locations/{id}", a.patchLocationHandler},
+		{"PATCH", "/visits/{id}", a.patchVisitHandler},
+		{"GET", "/users/{id}/history", a.userHistoryHandler},
+		{"GET", "/locations/{id}/history", a.locationHistoryHandler},
+		{"GET", "/visits/{id}/history", a.visitHistoryHandler},
+		{"GET", "/events", a.eventsHandler},
+
+		{"GET", "/metrics", a.metricsHandler},
+		{"GET", "/healthz", a.healthzHandler},
+		{"GET", "/readyz", a.readyzHandler},
+		{"GET", "/admin/reload", a.adminOnly(a.reloadStatusHandler)},
+		{"POST", "/admin/reload", a.adminOnly(a.reloadHandler)},
+		{"POST", "/admin/import", a.adminOnly(a.importHandler)},
 	}
-	if newVisit.Mark == nil {
-		http.Error(w, "Bad Request", 400)
-		return
+}
+
+func (a *api) newRouter() *mux.Router {
+	r := mux.NewRouter()
+	for _, rt := range a.routes() {
+		r.Handle(rt.template, a.build(rt)).Methods(rt.method)
 	}
+	r.NotFoundHandler = a.build(a.notFoundRoute())
+	r.MethodNotAllowedHandler = a.build(a.methodNotAllowedRoute())
+	return r
+}
 
-	visit := Visit{
-		ID:        *newVisit.ID,
-		Location:  *newVisit.Location,
-		User:      *newVisit.User,
-		VisitedAt: *newVisit.VisitedAt,
-		Mark:      *newVisit.Mark,
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(replayMain(os.Args[2:]))
+		case "validate":
+			os.Exit(validateMain(os.Args[2:]))
+		}
 	}
 
-	err = db.addVisit(&visit)
+	cfg, printOnly, err := loadConfig(os.Args[1:])
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		log.Fatal(err)
+	}
+	if printOnly {
+		printed := cfg
+		if printed.Admin.Token != "" {
+			printed.Admin.Token = "<redacted>"
+		}
+		out, err := yaml.Marshal(printed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(out)
 		return
 	}
+	changeFeed = newEventLog(cfg.EventBuffer)
+	startWebhooks(changeFeed, cfg.Webhooks)
 
-	_, err = w.Write([]byte("{}"))
+	a := newAPI(cfg)
+	srv, err := newServer(a)
 	if err != nil {
-		log.Println(err)
+		log.Fatal(err)
 	}
-}
 
-func main() {
-	port := flag.Int("port", 8080, "port number")
-	dataDir := flag.String("data", "./data/", "data directory for initialization")
-	flag.Parse()
+	// The data is loaded into the live database while the server already
+	// listens, answering 503 until it is complete.
+	db := newInmemoryDB(cfg.BTreeDegree, cfg.AgeReference, cfg.HistoryLimit, cfg.HistoryEntities)
+	db.attachFeed(changeFeed)
+	liveDB.Store(db)
+	go func() {
+		a.loadStartupData(db, cfg.DataDir)
+		a.watchReloadSignal()
+	}()
 
-	err := initializeData(*dataDir)
+	err = runServer(srv, cfg.Listen, time.Duration(cfg.ShutdownTimeout))
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	r := mux.NewRouter()
-	r.HandleFunc("/users/{id}", getUserHandler).Methods("GET")
-	r.HandleFunc("/locations/{id}", getLocationHandler).Methods("GET")
-	r.HandleFunc("/visits/{id}", getVisitHandler).Methods("GET")
-	r.HandleFunc("/users/{userID}/visits", getUserVisitsHandler).Methods("GET")
-	r.HandleFunc("/locations/{locationID}/avg", getLocationAverageHandler).Methods("GET")
-	r.HandleFunc("/users/new", newUserHandler).Methods("POST")
-	r.HandleFunc("/locations/new", newLocationHandler).Methods("POST")
-	r.HandleFunc("/visits/new", newVisitHandler).Methods("POST")
-	r.HandleFunc("/users/{id}", updateUserHandler).Methods("POST")
-	r.HandleFunc("/locations/{id}", updateLocationHandler).Methods("POST")
-	r.HandleFunc("/visits/{id}", updateVisitHandler).Methods("POST")
-
-	http.Handle("/", r)
-
-	addr := fmt.Sprintf(":%d", *port)
-	log.Println("Start running on", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	log.Println("Stopped")
 }
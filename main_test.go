@@ -0,0 +1,471 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var testCountries = []string{"Россия", "Германия", "Франция", "Испания"}
+
+// newTestDB returns a database with the given number of users, locations
+// and visits. Records are derived from their IDs, so every call returns
+// the same data.
+func newTestDB(tb testing.TB, users int, locations int, visits int) *InmemoryDB {
+	tb.Helper()
+	db := newInmemoryDB(BTreeDegree, defaultAgeReference, defaultConfig().HistoryLimit, defaultConfig().HistoryEntities)
+	db.addUsers(testUsers(1, users))
+	db.addLocations(testLocations(1, locations))
+	db.addVisits(testVisits(1, visits, users, locations))
+	return db
+}
+
+func testUsers(first int, n int) []*User {
+	users := make([]*User, n)
+	for i := range users {
+		id := int32(first + i)
+		gender := "m"
+		if id%2 == 0 {
+			gender = "f"
+		}
+		users[i] = &User{
+			ID:        id,
+			Email:     fmt.Sprintf("user%d@example.com", id),
+			FirstName: "First",
+			LastName:  "Last",
+			Gender:    gender,
+			BirthDate: -1000000000 + int64(id)*10000000,
+		}
+	}
+	return users
+}
+
+func testLocations(first int, n int) []*Location {
+	locations := make([]*Location, n)
+	for i := range locations {
+		id := int32(first + i)
+		locations[i] = &Location{
+			ID:       id,
+			Place:    fmt.Sprintf("Place %d", id),
+			Country:  testCountries[int(id)%len(testCountries)],
+			City:     "City",
+			Distance: int64(id % 100),
+		}
+	}
+	return locations
+}
+
+// testVisits returns visits spread over the first users and locations.
+func testVisits(first int, n int, users int, locations int) []*Visit {
+	visits := make([]*Visit, n)
+	for i := range visits {
+		id := int32(first + i)
+		visits[i] = &Visit{
+			ID:        id,
+			User:      1 + id%int32(users),
+			Location:  1 + id*7%int32(locations),
+			VisitedAt: 1000000000 + int64(id)*1000,
+			Mark:      int8(id % 6),
+		}
+	}
+	return visits
+}
+
+// newTestAPI makes db live and returns an api that serves it. The server
+// is marked ready and logs nothing.
+func newTestAPI(tb testing.TB, db *InmemoryDB) *api {
+	tb.Helper()
+	cfg := defaultConfig()
+	cfg.Warmup.Enabled = false
+	liveDB.Store(db)
+	atomic.StoreInt32(&startup.ready, 1)
+	structuredLog.SetOutput(ioutil.Discard)
+	return newAPI(cfg)
+}
+
+// serve sends a request through h and returns the response. header holds
+// pairs of header names and values.
+func serve(h http.Handler, method string, target string, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Add(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// checkVisitIndexes fails t unless every visit is listed under its user
+// and its location, and every listed visit belongs to the user or the
+// location it is listed under.
+func checkVisitIndexes(t *testing.T, db *InmemoryDB) {
+	t.Helper()
+	s := db.visits.load()
+	s.visits.each(func(r *visitRecord) {
+		if !containsInt32(s.visitsByUser.get(r.user), r.id) {
+			t.Errorf("visit %d is not listed for its user %d", r.id, r.user)
+		}
+		if !containsInt32(s.visitsByLocation.get(r.location), r.id) {
+			t.Errorf("visit %d is not listed for its location %d", r.id, r.location)
+		}
+	})
+	s.visitsByUser.each(func(user int32, visits []int32) {
+		for _, id := range visits {
+			if r, ok := s.visits.get(id); !ok || r.user != user {
+				t.Errorf("visit %d is listed for user %d but belongs to %d", id, user, r.user)
+			}
+		}
+	})
+	s.visitsByLocation.each(func(location int32, visits []int32) {
+		for _, id := range visits {
+			if r, ok := s.visits.get(id); !ok || r.location != location {
+				t.Errorf("visit %d is listed for location %d but belongs to %d", id, location, r.location)
+			}
+		}
+	})
+}
+
+func containsInt32(a []int32, x int32) bool {
+	i := searchInt32s(a, x)
+	return i < len(a) && a[i] == x
+}
+
+// TestConcurrentRoutes sends reads, writes and aggregates to the eleven
+// core routes from many goroutines at once. Run it with -race.
+func TestConcurrentRoutes(t *testing.T) {
+	const (
+		users     = 200
+		locations = 100
+		visits    = 2000
+		workers   = 8
+		requests  = 440
+	)
+	db := newTestDB(t, users, locations, visits)
+	router := newTestAPI(t, db).newRouter()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				id := 1 + (w*requests+i)%users
+				newID := 100000 + w*requests + i
+				var method, target, body string
+				switch i % 11 {
+				case 0:
+					method, target = "GET", fmt.Sprintf("/users/%d", id)
+				case 1:
+					method, target = "GET", fmt.Sprintf("/locations/%d", 1+id%locations)
+				case 2:
+					method, target = "GET", fmt.Sprintf("/visits/%d", 1+id*7%visits)
+				case 3:
+					method, target = "GET", fmt.Sprintf("/users/%d/visits?toDistance=50&country=%s", id, "Россия")
+				case 4:
+					method, target = "GET", fmt.Sprintf("/locations/%d/avg?gender=f&fromAge=20", 1+id%locations)
+				case 5:
+					method, target = "POST", "/users/new"
+					body = fmt.Sprintf(`{"id":%d,"email":"new%d@example.com","first_name":"N","last_name":"U","gender":"m","birth_date":0}`, newID, newID)
+				case 6:
+					method, target = "POST", "/locations/new"
+					body = fmt.Sprintf(`{"id":%d,"place":"New","country":"Россия","city":"C","distance":10}`, newID)
+				case 7:
+					method, target = "POST", "/visits/new"
+					body = fmt.Sprintf(`{"id":%d,"user":%d,"location":%d,"visited_at":1200000000,"mark":4}`, newID, id, 1+id%locations)
+				case 8:
+					method, target = "POST", fmt.Sprintf("/users/%d", id)
+					body = fmt.Sprintf(`{"email":"changed%d@example.com"}`, newID)
+				case 9:
+					method, target = "POST", fmt.Sprintf("/locations/%d", 1+id%locations)
+					body = fmt.Sprintf(`{"distance":%d}`, newID%100)
+				case 10:
+					method, target = "POST", fmt.Sprintf("/visits/%d", 1+id*7%visits)
+					body = fmt.Sprintf(`{"user":%d,"mark":%d}`, 1+newID%users, newID%6)
+				}
+				r := httptest.NewRequest(method, target, strings.NewReader(body))
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, r)
+				if rec.Code != http.StatusOK {
+					t.Errorf("%s %s: status %d: %s", method, target, rec.Code, rec.Body)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Each worker created one user, location and visit per 11 requests.
+	created := workers * requests / 11
+	u, l, v := db.counts()
+	if u != users+created || l != locations+created || v != visits+created {
+		t.Errorf("counts = %d, %d, %d; want %d, %d, %d", u, l, v,
+			users+created, locations+created, visits+created)
+	}
+	for id := int32(1); id <= users; id++ {
+		for _, visitID := range db.visits.load().visitsByUser.get(id) {
+			if visit := db.getVisit(visitID); visit == nil || visit.User != id {
+				t.Fatalf("visit %d is listed for user %d but belongs to %v", visitID, id, visit)
+			}
+		}
+	}
+}
+
+// lockShards locks the shards of db that are not skipped and returns a
+// function that unlocks them again.
+func lockShards(db *InmemoryDB, skip string) func() {
+	var locked []*timedMutex
+	for _, shard := range []struct {
+		name string
+		mux  *timedMutex
+	}{
+		{"users", &db.users.mux},
+		{"locations", &db.locations.mux},
+		{"visits", &db.visits.mux},
+	} {
+		if shard.name != skip {
+			shard.mux.Lock()
+			locked = append(locked, shard.mux)
+		}
+	}
+	return func() {
+		for _, mux := range locked {
+			mux.Unlock()
+		}
+	}
+}
+
+// The lock tests below call reads and writes from the goroutine that holds
+// the shard locks they must not take. A call that took one of them would
+// block for good, and go test would fail on its -timeout with the stack of
+// the stuck call.
+
+// TestReadsDuringWrite reproduces the deadlock of readers that lock a shard
+// twice: a writer is queued on the visits shard, which is held, while the
+// aggregate routes run. They must return the state from before the write,
+// and the written state once it is done.
+func TestReadsDuringWrite(t *testing.T) {
+	db := newTestDB(t, 20, 10, 100)
+	router := newTestAPI(t, db).newRouter()
+	get := func(target string) string {
+		t.Helper()
+		rec := serve(router, "GET", target, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", target, rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+	visitsBefore := get("/users/3/visits")
+	avgBefore := get("/locations/4/avg")
+
+	unlock := lockShards(db, "")
+	added := make(chan error)
+	go func() {
+		added <- db.addVisit(&Visit{ID: 1000, User: 3, Location: 4, VisitedAt: 2000000000, Mark: 5})
+	}()
+	if got := get("/users/3/visits"); got != visitsBefore {
+		t.Errorf("visits of user 3 during the write = %s, want %s", got, visitsBefore)
+	}
+	if got := get("/locations/4/avg"); got != avgBefore {
+		t.Errorf("average of location 4 during the write = %s, want %s", got, avgBefore)
+	}
+	unlock()
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := get("/users/3/visits?fromDate=1999999999"); !strings.Contains(got, `"visited_at":2000000000`) {
+		t.Errorf("visits of user 3 after the write = %s, want visit 1000", got)
+	}
+	if got := get("/locations/4/avg?fromDate=1999999999"); strings.TrimSpace(got) != `{"avg":5}` {
+		t.Errorf("average of location 4 after the write = %s, want the mark of visit 1000", got)
+	}
+	checkVisitIndexes(t, db)
+}
+
+// TestReadsTakeNoShardLock checks that every read, including the ones that
+// span shards, completes while all shard locks are held by someone else.
+func TestReadsTakeNoShardLock(t *testing.T) {
+	db := newTestDB(t, 20, 10, 100)
+	reads := []func(){
+		func() { db.getUser(1) },
+		func() { db.getLocation(1) },
+		func() { db.getVisit(1) },
+		func() { db.queryVisits(1, 0, 1<<40, "Россия", 100) },
+		func() { db.queryAverage(1, 0, 1<<40, 0, 200, "f") },
+		func() { db.getUserAsOf(1, 1<<40) },
+		func() { db.getLocationAsOf(1, 1<<40) },
+		func() { db.getVisitAsOf(1, 1<<40) },
+		func() { db.queryVisitsAsOf(1, 1<<40, 0, 1<<40, "", 100) },
+		func() { db.queryAverageAsOf(1, 1<<40, 0, 1<<40, 0, 200, "") },
+		func() { db.counts() },
+	}
+	unlock := lockShards(db, "")
+	defer unlock()
+	for _, read := range reads {
+		read()
+	}
+}
+
+// TestWritesLockOneShard checks that every write completes while the locks
+// of the other shards are held, so no write can take part in a lock cycle.
+func TestWritesLockOneShard(t *testing.T) {
+	db := newTestDB(t, 20, 10, 100)
+	email := "changed@example.com"
+	distance := int64(5)
+	mark := int8(2)
+	patch, err := parseMergePatch([]byte(`{"birth_date":0,"distance":1,"mark":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := map[string][]func(){
+		"users": {
+			func() { db.addUser(testUsers(100, 1)[0]) },
+			func() { db.addUsers(testUsers(101, 2)) },
+			func() { db.addUsersAtomic(testUsers(103, 2)) },
+			func() { db.loadUsers(testUsers(1, 2), true) },
+			func() { db.updateUser(1, &UserUpdate{Email: &email}, "") },
+			func() { db.putUser(testUsers(2, 1)[0], "", "") },
+			func() { db.patchUser(3, patch, "") },
+			func() { db.removeUser(4) },
+		},
+		"locations": {
+			func() { db.addLocation(testLocations(100, 1)[0]) },
+			func() { db.addLocations(testLocations(101, 2)) },
+			func() { db.addLocationsAtomic(testLocations(103, 2)) },
+			func() { db.loadLocations(testLocations(1, 2), true) },
+			func() { db.updateLocation(1, &LocationUpdate{Distance: &distance}, "") },
+			func() { db.putLocation(testLocations(2, 1)[0], "", "") },
+			func() { db.patchLocation(3, patch, "") },
+			func() { db.removeLocation(4) },
+		},
+		"visits": {
+			func() { db.addVisit(testVisits(200, 1, 20, 10)[0]) },
+			func() { db.addVisits(testVisits(201, 2, 20, 10)) },
+			func() { db.addVisitsAtomic(testVisits(203, 2, 20, 10)) },
+			func() { db.loadVisits(testVisits(1, 2, 20, 10), true) },
+			func() { db.updateVisit(1, &VisitUpdate{Mark: &mark}, "") },
+			func() { db.putVisit(testVisits(2, 1, 20, 10)[0], "", "") },
+			func() { db.patchVisit(3, patch, "") },
+			func() { db.removeVisit(4) },
+		},
+	}
+	for shard, calls := range writes {
+		unlock := lockShards(db, shard)
+		for _, write := range calls {
+			write()
+		}
+		unlock()
+	}
+}
+
+// TestConcurrentWritesAcrossShards runs writes to all shards and the reads
+// spanning them side by side, in a fixed pattern. A lock cycle among them
+// would keep it from finishing.
+func TestConcurrentWritesAcrossShards(t *testing.T) {
+	const rounds = 500
+	db := newTestDB(t, 50, 20, 500)
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				fn(i)
+			}
+		}()
+	}
+	run(func(i int) {
+		email := fmt.Sprint(i)
+		db.updateUser(int32(1+i%50), &UserUpdate{Email: &email}, "")
+	})
+	run(func(i int) {
+		distance := int64(i % 100)
+		db.updateLocation(int32(1+i%20), &LocationUpdate{Distance: &distance}, "")
+	})
+	run(func(i int) {
+		user := int32(1 + i%50)
+		db.updateVisit(int32(1+i%500), &VisitUpdate{User: &user}, "")
+	})
+	run(func(i int) { db.addVisits(testVisits(1000+i, 1, 50, 20)) })
+	run(func(i int) { db.queryVisits(int32(1+i%50), 0, 1<<40, "", 100) })
+	run(func(i int) { db.queryAverage(int32(1+i%20), 0, 1<<40, 0, 200, "") })
+	wg.Wait()
+}
+
+// The read benchmarks run in parallel, so -cpu tells how reads scale with
+// the cores, and -cpu 1 gives their single-core cost.
+//
+// On one core, getUser takes about five times as long as when it returned
+// the stored *User under a read lock. The difference is the User it now
+// builds from the value record, a 96-byte allocation, and it is small next
+// to what encoding the response costs. The aggregate queries are about three
+// times faster than with the lock, since they walk value records instead of
+// pointers.
+
+func BenchmarkGetUser(b *testing.B) {
+	db := newTestDB(b, benchUsers, benchLocations, benchVisits)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := int32(0)
+		for pb.Next() {
+			id = id%benchUsers + 1
+			db.getUser(id)
+		}
+	})
+}
+
+func BenchmarkQueryVisits(b *testing.B) {
+	db := newTestDB(b, benchUsers, benchLocations, benchVisits)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := int32(0)
+		for pb.Next() {
+			id = id%benchUsers + 1
+			db.queryVisits(id, 0, 1<<40, "Россия", 50)
+		}
+	})
+}
+
+func BenchmarkQueryAverage(b *testing.B) {
+	db := newTestDB(b, benchUsers, benchLocations, benchVisits)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := int32(0)
+		for pb.Next() {
+			id = id%benchLocations + 1
+			db.queryAverage(id, 0, 1<<40, 20, 60, "f")
+		}
+	})
+}
+
+// BenchmarkUpdateVisit measures a single write, including what it copies to
+// keep the published snapshot unchanged.
+func BenchmarkUpdateVisit(b *testing.B) {
+	db := newTestDB(b, benchUsers, benchLocations, benchVisits)
+	b.ReportAllocs()
+	m := startGCMeter(b)
+	for i := 0; i < b.N; i++ {
+		mark := int8(i % 6)
+		db.updateVisit(int32(1+i%benchVisits), &VisitUpdate{Mark: &mark}, "")
+	}
+	m.report(b)
+}
+
+// BenchmarkUpdateUser is BenchmarkUpdateVisit for the larger user records.
+func BenchmarkUpdateUser(b *testing.B) {
+	db := newTestDB(b, benchUsers, benchLocations, benchVisits)
+	b.ReportAllocs()
+	m := startGCMeter(b)
+	for i := 0; i < b.N; i++ {
+		birthDate := int64(i)
+		db.updateUser(int32(1+i%benchUsers), &UserUpdate{BirthDate: &birthDate}, "")
+	}
+	m.report(b)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the request latency histograms, in
+// seconds. Contest responses take tens of microseconds, so the low end is
+// fine grained.
+var latencyBuckets = []float64{
+	0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+// routeMetrics are the counters of a single route. All fields are updated
+// atomically, so recording a request never takes a lock.
+type routeMetrics struct {
+	template string
+	method   string
+	buckets  []uint64 // one per latencyBuckets entry, plus +Inf
+	sumNanos uint64
+	statuses [600]uint64
+}
+
+// metrics holds the counters of every route, each registered once however
+// many times the engines are built.
+var metrics = struct {
+	mux     sync.Mutex
+	routes  []*routeMetrics
+	byRoute map[string]*routeMetrics // method + " " + template
+}{
+	byRoute: make(map[string]*routeMetrics),
+}
+
+// newRouteMetrics returns the counters of rt, registering them the first
+// time the route is built.
+func newRouteMetrics(rt route) *routeMetrics {
+	method := rt.method
+	if method == "" {
+		method = "any"
+	}
+	key := method + " " + rt.template
+
+	metrics.mux.Lock()
+	defer metrics.mux.Unlock()
+	if m, ok := metrics.byRoute[key]; ok {
+		return m
+	}
+	m := &routeMetrics{
+		template: rt.template,
+		method:   method,
+		buckets:  make([]uint64, len(latencyBuckets)+1),
+	}
+	metrics.routes = append(metrics.routes, m)
+	metrics.byRoute[key] = m
+	return m
+}
+
+func (m *routeMetrics) observe(status int, elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	atomic.AddUint64(&m.buckets[i], 1)
+	atomic.AddUint64(&m.sumNanos, uint64(elapsed))
+	if status >= 0 && status < len(m.statuses) {
+		atomic.AddUint64(&m.statuses[status], 1)
+	}
+}
+
+// metricsMiddleware counts requests per route and status, and records
+// their latency.
+func (a *api) metricsMiddleware(rt route, next http.Handler) http.Handler {
+	m := newRouteMetrics(rt)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		m.observe(sw.statusCode(), time.Since(start))
+	})
+}
+
+// timedMutex is a sync.Mutex that keeps track of how long Lock waited.
+type timedMutex struct {
+	sync.Mutex
+	waitNanos    uint64
+	acquisitions uint64
+}
+
+func (l *timedMutex) Lock() {
+	start := time.Now()
+	l.Mutex.Lock()
+	atomic.AddUint64(&l.waitNanos, uint64(time.Since(start)))
+	atomic.AddUint64(&l.acquisitions, 1)
+}
+
+// btreeMaxHeight is the largest height a B-tree of the given degree can
+// have with n items. google/btree does not expose the real height, but
+// since every node but the root holds at least degree-1 items, this bound
+// is tight enough to spot degenerate trees.
+func btreeMaxHeight(n int, degree int) int {
+	if n == 0 {
+		return 0
+	}
+	return 1 + int(math.Floor(math.Log(float64(n+1)/2)/math.Log(float64(degree))))
+}
+
+// denseIndexDepth is the number of lookups that find a record in the dense
+// part of a table: the directory page, then the chunk.
+const denseIndexDepth = 2
+
+func formatSeconds(nanos uint64) string {
+	return strconv.FormatFloat(float64(nanos)/1e9, 'g', -1, 64)
+}
+
+func writeMetrics(w *bufio.Writer, d *InmemoryDB) {
+	metrics.mux.Lock()
+	routes := append([]*routeMetrics(nil), metrics.routes...)
+	metrics.mux.Unlock()
+
+	fmt.Fprintln(w, "# HELP hicup_http_requests_total Requests served, by route template, method and status code.")
+	fmt.Fprintln(w, "# TYPE hicup_http_requests_total counter")
+	for _, m := range routes {
+		for status := range m.statuses {
+			count := atomic.LoadUint64(&m.statuses[status])
+			if count == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "hicup_http_requests_total{route=%q,method=%q,code=\"%d\"} %d\n", m.template, m.method, status, count)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP hicup_http_request_duration_seconds Request latency, by route template and method.")
+	fmt.Fprintln(w, "# TYPE hicup_http_request_duration_seconds histogram")
+	for _, m := range routes {
+		cumulative := uint64(0)
+		for i, le := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&m.buckets[i])
+			fmt.Fprintf(w, "hicup_http_request_duration_seconds_bucket{route=%q,method=%q,le=\"%g\"} %d\n", m.template, m.method, le, cumulative)
+		}
+		cumulative += atomic.LoadUint64(&m.buckets[len(latencyBuckets)])
+		fmt.Fprintf(w, "hicup_http_request_duration_seconds_bucket{route=%q,method=%q,le=\"+Inf\"} %d\n", m.template, m.method, cumulative)
+		fmt.Fprintf(w, "hicup_http_request_duration_seconds_sum{route=%q,method=%q} %s\n", m.template, m.method, formatSeconds(atomic.LoadUint64(&m.sumNanos)))
+		fmt.Fprintf(w, "hicup_http_request_duration_seconds_count{route=%q,method=%q} %d\n", m.template, m.method, cumulative)
+	}
+
+	userSnap := d.users.load()
+	locationSnap := d.locations.load()
+	visitSnap := d.visits.load()
+
+	fmt.Fprintln(w, "# HELP hicup_entities Entities stored in InmemoryDB, by type.")
+	fmt.Fprintln(w, "# TYPE hicup_entities gauge")
+	fmt.Fprintf(w, "hicup_entities{type=\"user\"} %d\n", userSnap.users.n)
+	fmt.Fprintf(w, "hicup_entities{type=\"location\"} %d\n", locationSnap.locations.n)
+	fmt.Fprintf(w, "hicup_entities{type=\"visit\"} %d\n", visitSnap.visits.n)
+
+	tables := []struct {
+		name  string
+		stats tableStats
+	}{
+		{"users", userSnap.users.stats()},
+		{"locations", locationSnap.locations.stats()},
+		{"visits", visitSnap.visits.stats()},
+		{"visitsByUser", visitSnap.visitsByUser.stats()},
+		{"visitsByLocation", visitSnap.visitsByLocation.stats()},
+	}
+	fmt.Fprintln(w, "# HELP hicup_table_records Records stored in each table; visit IDs for the visitsBy tables.")
+	fmt.Fprintln(w, "# TYPE hicup_table_records gauge")
+	for _, t := range tables {
+		fmt.Fprintf(w, "hicup_table_records{table=%q} %d\n", t.name, t.stats.records)
+	}
+	fmt.Fprintln(w, "# HELP hicup_table_chunks Allocated chunks of each table.")
+	fmt.Fprintln(w, "# TYPE hicup_table_chunks gauge")
+	for _, t := range tables {
+		fmt.Fprintf(w, "hicup_table_chunks{table=%q} %d\n", t.name, t.stats.chunks)
+	}
+	fmt.Fprintln(w, "# HELP hicup_table_sparse_records IDs of each table kept in its sparse B-tree because their ID is too large.")
+	fmt.Fprintln(w, "# TYPE hicup_table_sparse_records gauge")
+	for _, t := range tables {
+		fmt.Fprintf(w, "hicup_table_sparse_records{table=%q} %d\n", t.name, t.stats.sparse)
+	}
+	fmt.Fprintln(w, "# HELP hicup_table_index_depth Lookups needed to find a record of each table, in its dense chunks or, at most, in its sparse B-tree.")
+	fmt.Fprintln(w, "# TYPE hicup_table_index_depth gauge")
+	for _, t := range tables {
+		dense := 0
+		if t.stats.chunks > 0 {
+			dense = denseIndexDepth
+		}
+		fmt.Fprintf(w, "hicup_table_index_depth{table=%q,index=\"dense\"} %d\n", t.name, dense)
+		fmt.Fprintf(w, "hicup_table_index_depth{table=%q,index=\"sparse\"} %d\n", t.name, btreeMaxHeight(t.stats.sparse, d.degree))
+	}
+	fmt.Fprintln(w, "# HELP hicup_interned_strings Distinct countries, cities and genders stored.")
+	fmt.Fprintln(w, "# TYPE hicup_interned_strings gauge")
+	fmt.Fprintf(w, "hicup_interned_strings %d\n", d.strings.len())
+
+	shards := []struct {
+		name string
+		mux  *timedMutex
+	}{
+		{"users", &d.users.mux},
+		{"locations", &d.locations.mux},
+		{"visits", &d.visits.mux},
+	}
+	fmt.Fprintln(w, "# HELP hicup_db_lock_wait_seconds_total Time writers spent waiting for InmemoryDB shard locks.")
+	fmt.Fprintln(w, "# TYPE hicup_db_lock_wait_seconds_total counter")
+	for _, s := range shards {
+		fmt.Fprintf(w, "hicup_db_lock_wait_seconds_total{shard=%q} %s\n", s.name, formatSeconds(atomic.LoadUint64(&s.mux.waitNanos)))
+	}
+	fmt.Fprintln(w, "# HELP hicup_db_lock_acquisitions_total Times InmemoryDB shard locks were acquired.")
+	fmt.Fprintln(w, "# TYPE hicup_db_lock_acquisitions_total counter")
+	for _, s := range shards {
+		fmt.Fprintf(w, "hicup_db_lock_acquisitions_total{shard=%q} %d\n", s.name, atomic.LoadUint64(&s.mux.acquisitions))
+	}
+}
+
+func (a *api) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw, currentDB())
+	if err := bw.Flush(); err != nil {
+		logRequestError(r, "write response", err)
+	}
+}
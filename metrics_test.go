@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsRegisteredOnce(t *testing.T) {
+	a := newTestAPI(t, newTestDB(t, 10, 10, 10))
+	// Both engines build the routes, and tests build them over and over.
+	a.newRouter()
+	newRawServer(a)
+	router := a.newRouter()
+
+	for i := 0; i < 3; i++ {
+		serve(router, "GET", "/users/1", "")
+	}
+	body := serve(router, "GET", "/metrics", "").Body.String()
+
+	series := `hicup_http_request_duration_seconds_count{route="/users/{id}",method="GET"} `
+	if n := strings.Count(body, series); n != 1 {
+		t.Fatalf("%d series %q, want 1", n, series)
+	}
+	// Earlier tests may have served the route too.
+	if !strings.Contains(body, `hicup_http_requests_total{route="/users/{id}",method="GET",code="200"} `) {
+		t.Error("requests to /users/{id} not counted")
+	}
+	for _, line := range []string{
+		`hicup_table_index_depth{table="users",index="dense"} 2`,
+		`hicup_table_index_depth{table="users",index="sparse"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("no %q in the metrics", line)
+		}
+	}
+}
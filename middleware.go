@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// routeMiddleware wraps the handler of one route. Middlewares are applied
+// when an engine is built, so they know their route without looking it up
+// on every request, and both engines run exactly the same chain.
+type routeMiddleware func(a *api, rt route, next http.Handler) http.Handler
+
+// routeMiddlewares are applied to every route, the first one outermost.
+var routeMiddlewares = []routeMiddleware{
+	(*api).requestIDMiddleware,
+	(*api).accessLogMiddleware,
+	(*api).metricsMiddleware,
+	(*api).readinessMiddleware,
+	(*api).writeGateMiddleware,
+}
+
+// notFoundRoute and methodNotAllowedRoute answer requests that match no
+// route. They go through the middlewares like any other route.
+func (a *api) notFoundRoute() route {
+	return route{
+		template: "not_found",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			a.writeError(w, r, errNotFound)
+		},
+	}
+}
+
+func (a *api) methodNotAllowedRoute() route {
+	return route{
+		template: "method_not_allowed",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			a.writeError(w, r, errMethodNotAllowed)
+		},
+	}
+}
+
+// build returns the handler of rt wrapped in all middlewares.
+func (a *api) build(rt route) http.Handler {
+	var h http.Handler = rt.handler
+	for i := len(routeMiddlewares) - 1; i >= 0; i-- {
+		h = routeMiddlewares[i](a, rt, h)
+	}
+	return h
+}
+
+// statusWriter records the status code and the body size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += n
+	return n, err
+}
+
+// Flush implements http.Flusher if the wrapped writer does, so streaming
+// handlers work behind the middlewares.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// statusCode returns the recorded status, which is 200 if the handler
+// never wrote anything.
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+var (
+	errAdminDisabled = &apiError{
+		status:  http.StatusForbidden,
+		code:    "admin_disabled",
+		message: "admin endpoints are disabled, set admin.token to enable them",
+	}
+	errUnauthorized = &apiError{
+		status:  http.StatusUnauthorized,
+		code:    "unauthorized",
+		message: "a valid admin token is required",
+		field:   "Authorization",
+	}
+)
+
+// adminOnly makes next answer only requests that carry the admin token as
+// a bearer token.
+func (a *api) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.config.Admin.Token == "" {
+			a.writeError(w, r, errAdminDisabled)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.config.Admin.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			a.writeError(w, r, errUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeGate is held shared by the requests that may write to the live
+// database, and exclusively by a reload while it replaces the database,
+// so no write can land on a database that is no longer live.
+var writeGate sync.RWMutex
+
+// writeGateMiddleware holds the write gate for the requests of routes that
+// may write.
+func (a *api) writeGateMiddleware(rt route, next http.Handler) http.Handler {
+	if rt.method == "" || rt.method == "GET" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeGate.RLock()
+		defer writeGate.RUnlock()
+		next.ServeHTTP(w, r)
+	})
+}
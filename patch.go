@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Media types of PATCH bodies.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+var errUnsupportedPatch = &apiError{
+	status:  http.StatusUnsupportedMediaType,
+	code:    "unsupported_media_type",
+	message: "Content-Type must be " + mergePatchType + " or " + jsonPatchType,
+	field:   "Content-Type",
+}
+
+func errInvalidPatch(message string) *apiError {
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "invalid_patch",
+		message: message,
+	}
+}
+
+// errPatchConflict reports an operation that does not apply to the current
+// entity, such as the removal of a field it does not have.
+func errPatchConflict(message string) *apiError {
+	return &apiError{
+		status:  http.StatusConflict,
+		code:    "patch_conflict",
+		message: message,
+	}
+}
+
+func errPatchTestFailed(path string) *apiError {
+	return &apiError{
+		status:  http.StatusConflict,
+		code:    "patch_test_failed",
+		message: "test operation failed",
+		field:   path,
+	}
+}
+
+// entityPatch is a parsed PATCH body. apply returns doc, the JSON form of
+// the current entity, with the patch applied. It may modify doc.
+type entityPatch interface {
+	apply(doc interface{}) (interface{}, error)
+}
+
+// parsePatch parses a PATCH body of the given Content-Type.
+func parsePatch(contentType string, body []byte) (entityPatch, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case mergePatchType:
+		return parseMergePatch(body)
+	case jsonPatchType:
+		return parseJSONPatch(body)
+	}
+	return nil, errUnsupportedPatch
+}
+
+// decodeJSON decodes body, keeping numbers as json.Number so that int64
+// fields survive a round trip.
+func decodeJSON(body []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// mergePatch is a JSON Merge Patch (RFC 7386). A null member removes the
+// field, which fails validation for the fields every entity requires.
+type mergePatch map[string]interface{}
+
+func parseMergePatch(body []byte) (entityPatch, error) {
+	v, err := decodeJSON(body)
+	if err != nil {
+		return nil, errInvalidBody(err)
+	}
+	patch, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errInvalidPatch("merge patch must be a JSON object")
+	}
+	return mergePatch(patch), nil
+}
+
+func (p mergePatch) apply(doc interface{}) (interface{}, error) {
+	return mergeValue(doc, map[string]interface{}(p)), nil
+}
+
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergeValue(t[k], v)
+	}
+	return t
+}
+
+// patchOperation is an operation of a JSON Patch.
+type patchOperation struct {
+	op    string
+	path  []string
+	from  []string
+	value interface{}
+}
+
+// jsonPatch is a JSON Patch (RFC 6902). Its operations apply in order and
+// either all of them do or none.
+type jsonPatch []patchOperation
+
+func parseJSONPatch(body []byte) (entityPatch, error) {
+	v, err := decodeJSON(body)
+	if err != nil {
+		return nil, errInvalidBody(err)
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, errInvalidPatch("JSON patch must be an array of operations")
+	}
+	patch := make(jsonPatch, len(items))
+	for i, item := range items {
+		op, err := parsePatchOperation(item)
+		if err != nil {
+			return nil, errInvalidPatch(fmt.Sprintf("operation %d: %s", i, err))
+		}
+		patch[i] = op
+	}
+	return patch, nil
+}
+
+func parsePatchOperation(item interface{}) (patchOperation, error) {
+	var op patchOperation
+	members, ok := item.(map[string]interface{})
+	if !ok {
+		return op, fmt.Errorf("must be an object")
+	}
+	op.op, ok = members["op"].(string)
+	if !ok {
+		return op, fmt.Errorf("op must be a string")
+	}
+	var err error
+	op.path, err = parsePointerMember(members, "path")
+	if err != nil {
+		return op, err
+	}
+	switch op.op {
+	case "add", "replace", "test":
+		if op.value, ok = members["value"]; !ok {
+			return op, fmt.Errorf("value is required")
+		}
+	case "move", "copy":
+		op.from, err = parsePointerMember(members, "from")
+		if err != nil {
+			return op, err
+		}
+		if op.op == "move" && len(op.from) < len(op.path) && pointerHasPrefix(op.path, op.from) {
+			return op, fmt.Errorf("cannot move a value into itself")
+		}
+	case "remove":
+	default:
+		return op, fmt.Errorf("unknown op %q", op.op)
+	}
+	return op, nil
+}
+
+var (
+	pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+	pointerEscaper   = strings.NewReplacer("~", "~0", "/", "~1")
+)
+
+// parsePointerMember parses the JSON Pointer (RFC 6901) in members[name]
+// into its reference tokens.
+func parsePointerMember(members map[string]interface{}, name string) ([]string, error) {
+	s, ok := members[name].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a string", name)
+	}
+	if s == "" {
+		return []string{}, nil
+	}
+	if s[0] != '/' {
+		return nil, fmt.Errorf("%s must be empty or start with /", name)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = pointerUnescaper.Replace(token)
+	}
+	return tokens, nil
+}
+
+func pointerHasPrefix(tokens []string, prefix []string) bool {
+	if len(prefix) > len(tokens) {
+		return false
+	}
+	for i := range prefix {
+		if tokens[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// formatPointer returns the JSON Pointer of tokens.
+func formatPointer(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteByte('/')
+		b.WriteString(pointerEscaper.Replace(token))
+	}
+	return b.String()
+}
+
+func (p jsonPatch) apply(doc interface{}) (interface{}, error) {
+	var err error
+	for i, op := range p {
+		doc, err = op.apply(doc)
+		if err != nil {
+			if apiErr, ok := err.(*apiError); ok {
+				return nil, apiErr
+			}
+			return nil, errPatchConflict(fmt.Sprintf("operation %d: %s", i, err))
+		}
+	}
+	return doc, nil
+}
+
+func (op *patchOperation) apply(doc interface{}) (interface{}, error) {
+	switch op.op {
+	case "add":
+		return pointerAdd(doc, op.path, op.value, false)
+	case "replace":
+		return pointerAdd(doc, op.path, op.value, true)
+	case "remove":
+		doc, _, err := pointerRemove(doc, op.path)
+		return doc, err
+	case "move":
+		doc, value, err := pointerRemove(doc, op.from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, op.path, value, false)
+	case "copy":
+		value, err := pointerGet(doc, op.from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, op.path, copyValue(value), false)
+	default: // test
+		value, err := pointerGet(doc, op.path)
+		if err != nil || !equalValues(value, op.value) {
+			return nil, errPatchTestFailed(formatPointer(op.path))
+		}
+		return doc, nil
+	}
+}
+
+// arrayIndex parses the token of an array element. end allows "-" and
+// len(a), which refer to the position after the last element.
+func arrayIndex(a []interface{}, token string, end bool) (int, error) {
+	if end && token == "-" {
+		return len(a), nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("%q is not an array index", token)
+	}
+	if i > len(a) || (i == len(a) && !end) {
+		return 0, fmt.Errorf("index %d is out of range", i)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for i, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%s does not exist", formatPointer(tokens[:i+1]))
+			}
+			doc = value
+		case []interface{}:
+			j, err := arrayIndex(node, token, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[j]
+		default:
+			return nil, fmt.Errorf("%s does not exist", formatPointer(tokens[:i+1]))
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd sets the value at tokens and returns the new doc. Array
+// elements are inserted, unless replace is set; replace also requires the
+// target to exist.
+func pointerAdd(doc interface{}, tokens []string, value interface{}, replace bool) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	token, last := tokens[0], len(tokens) == 1
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[token]
+		if !last {
+			if !ok {
+				return nil, fmt.Errorf("/%s does not exist", token)
+			}
+			child, err := pointerAdd(child, tokens[1:], value, replace)
+			if err != nil {
+				return nil, err
+			}
+			node[token] = child
+			return node, nil
+		}
+		if replace && !ok {
+			return nil, fmt.Errorf("/%s does not exist", token)
+		}
+		node[token] = value
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(node, token, last && !replace)
+		if err != nil {
+			return nil, err
+		}
+		if !last {
+			child, err := pointerAdd(node[i], tokens[1:], value, replace)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = child
+			return node, nil
+		}
+		if replace {
+			node[i] = value
+			return node, nil
+		}
+		node = append(node, nil)
+		copy(node[i+1:], node[i:])
+		node[i] = value
+		return node, nil
+	}
+	return nil, fmt.Errorf("/%s does not exist", token)
+}
+
+// pointerRemove removes the value at tokens and returns the new doc and
+// the removed value.
+func pointerRemove(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole entity")
+	}
+	token, last := tokens[0], len(tokens) == 1
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("/%s does not exist", token)
+		}
+		if last {
+			delete(node, token)
+			return node, child, nil
+		}
+		child, removed, err := pointerRemove(child, tokens[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		node[token] = child
+		return node, removed, nil
+	case []interface{}:
+		i, err := arrayIndex(node, token, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if last {
+			removed := node[i]
+			return append(node[:i], node[i+1:]...), removed, nil
+		}
+		child, removed, err := pointerRemove(node[i], tokens[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		node[i] = child
+		return node, removed, nil
+	}
+	return nil, nil, fmt.Errorf("/%s does not exist", token)
+}
+
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			c[k] = copyValue(x)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, x := range v {
+			c[i] = copyValue(x)
+		}
+		return c
+	}
+	return v
+}
+
+// equalValues compares JSON values as the test operation does: numbers by
+// value, objects regardless of member order.
+func equalValues(a interface{}, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, x := range a {
+			y, ok := b[k]
+			if !ok || !equalValues(x, y) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equalValues(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x, err := a.Int64(); err == nil {
+			if y, err := b.Int64(); err == nil {
+				return x == y
+			}
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	}
+	return a == b
+}
+
+// entityRequest is what NewUser, NewLocation and NewVisit have in common.
+type entityRequest interface {
+	validate() error
+}
+
+// patchEntity applies patch to entity and decodes the result into into,
+// which is validated like the body of a create.
+func patchEntity(entity interface{}, patch entityPatch, into entityRequest) error {
+	b, err := json.Marshal(entity)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeJSON(b)
+	if err != nil {
+		return err
+	}
+	doc, err = patch.apply(doc)
+	if err != nil {
+		return err
+	}
+	fields, ok := doc.(map[string]interface{})
+	if !ok {
+		return errInvalidPatch("patched entity must be a JSON object")
+	}
+	for k, v := range fields {
+		if v == nil {
+			return errNullField(k)
+		}
+	}
+
+	b, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(into); err != nil {
+		return errInvalidBody(err)
+	}
+	return into.validate()
+}
+
+// patchUser applies patch to the user with id under the shard lock, so
+// test operations and If-Match see the state the patch is applied to. It
+// returns the same errors as updateUser, and those of the patch.
+func (d *InmemoryDB) patchUser(id int32, patch entityPatch, ifMatch string) (*User, error) {
+	d.users.mux.Lock()
+	defer d.users.unlock()
+
+	old := d.users.work.get(id)
+	if old == nil {
+		return nil, errNotFound
+	}
+	if err := checkIfMatch(ifMatch, d.etag(old.Version)); err != nil {
+		return nil, err
+	}
+	var newUser NewUser
+	if err := patchEntity(old, patch, &newUser); err != nil {
+		return nil, err
+	}
+	if *newUser.ID != id {
+		return nil, errInvalidField("id", "must not be changed")
+	}
+
+	user := newUser.user()
+	if err := d.users.work.admit(user); err != nil {
+		return nil, err
+	}
+	user.Version = old.Version + 1
+	d.users.history.record(id, revision{version: old.Version, entity: old}, revision{version: user.Version, entity: user})
+	d.users.work.put(user)
+	d.users.publish()
+	d.users.events.emit(eventUpdate, id, user.Version, *user)
+	return user, nil
+}
+
+func (d *InmemoryDB) patchLocation(id int32, patch entityPatch, ifMatch string) (*Location, error) {
+	d.locations.mux.Lock()
+	defer d.locations.unlock()
+
+	old := d.locations.work.get(id)
+	if old == nil {
+		return nil, errNotFound
+	}
+	if err := checkIfMatch(ifMatch, d.etag(old.Version)); err != nil {
+		return nil, err
+	}
+	var newLocation NewLocation
+	if err := patchEntity(old, patch, &newLocation); err != nil {
+		return nil, err
+	}
+	if *newLocation.ID != id {
+		return nil, errInvalidField("id", "must not be changed")
+	}
+
+	location := newLocation.location()
+	if err := d.locations.work.admit(location); err != nil {
+		return nil, err
+	}
+	location.Version = old.Version + 1
+	d.locations.history.record(id, revision{version: old.Version, entity: old}, revision{version: location.Version, entity: location})
+	d.locations.work.put(location)
+	d.locations.publish()
+	d.locations.events.emit(eventUpdate, id, location.Version, *location)
+	return location, nil
+}
+
+// patchVisit is the visit counterpart of patchUser. Like updateVisit, it
+// rewrites the indexes before the next snapshot is published.
+func (d *InmemoryDB) patchVisit(id int32, patch entityPatch, ifMatch string) (*Visit, error) {
+	d.visits.mux.Lock()
+	defer d.visits.unlock()
+
+	old := d.visits.work.get(id)
+	if old == nil {
+		return nil, errNotFound
+	}
+	if err := checkIfMatch(ifMatch, d.etag(old.Version)); err != nil {
+		return nil, err
+	}
+	var newVisit NewVisit
+	if err := patchEntity(old, patch, &newVisit); err != nil {
+		return nil, err
+	}
+	if *newVisit.ID != id {
+		return nil, errInvalidField("id", "must not be changed")
+	}
+
+	visit := newVisit.visit()
+	visit.Version = old.Version + 1
+	d.visits.history.record(id, revision{version: old.Version, entity: old}, revision{version: visit.Version, entity: visit})
+	d.visits.work.replace(old, visit)
+	d.visits.publish()
+	d.visits.events.emit(eventUpdate, id, visit.Version, *visit)
+	return visit, nil
+}
+
+// readPatch parses the id and the patch of a PATCH request.
+func readPatch(r *http.Request) (int32, entityPatch, error) {
+	id, err := parseInt32(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, nil, errNotFound
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logClientError(r, "read body", err)
+		return 0, nil, errInvalidBody(err)
+	}
+	patch, err := parsePatch(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, patch, nil
+}
+
+// writePatched answers a successful PATCH like the update handlers do.
+func writePatched(w http.ResponseWriter, r *http.Request, etag string) {
+	w.Header().Set("ETag", etag)
+	_, err := w.Write([]byte("{}"))
+	if err != nil {
+		logRequestError(r, "write response", err)
+	}
+}
+
+// writePatchError reports err, advertising the accepted patch formats if
+// the Content-Type was not one of them.
+func (a *api) writePatchError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errUnsupportedPatch {
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+	}
+	a.writeError(w, r, err)
+}
+
+// patchUserHandler applies a JSON Merge Patch or a JSON Patch to the user
+// with the ID of the path. Unlike POST /users/{id}, a merge patch may set
+// fields to null, which removes them, so the result has to be a complete
+// user to be stored.
+func (a *api) patchUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, patch, err := readPatch(r)
+	if err != nil {
+		a.writePatchError(w, r, err)
+		return
+	}
+	db := currentDB()
+	user, err := db.patchUser(id, patch, headerList(r, "If-Match"))
+	if err != nil {
+		a.writePatchError(w, r, err)
+		return
+	}
+	writePatched(w, r, db.etag(user.Version))
+}
+
+func (a *api) patchLocationHandler(w http.ResponseWriter, r *http.Request) {
+	id, patch, err := readPatch(r)
+	if err != nil {
+		a.writePatchError(w, r, err)
+		return
+	}
+	db := currentDB()
+	location, err := db.patchLocation(id, patch, headerList(r, "If-Match"))
+	if err != nil {
+		a.writePatchError(w, r, err)
+		return
+	}
+	writePatched(w, r, db.etag(location.Version))
+}
+
+func (a *api) patchVisitHandler(w http.ResponseWriter, r *http.Request) {
+	id, patch, err := readPatch(r)
+	if err != nil {
+		a.writePatchError(w, r, err)
+		return
+	}
+	db := currentDB()
+	visit, err := db.patchVisit(id, patch, headerList(r, "If-Match"))
+	if err != nil {
+		a.writePatchError(w, r, err)
+		return
+	}
+	writePatched(w, r, db.etag(visit.Version))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// applyPatch applies patch, parsed as contentType, to the JSON doc.
+func applyPatch(t *testing.T, contentType string, doc string, patch string) (interface{}, error) {
+	t.Helper()
+	p, err := parsePatch(contentType, []byte(patch))
+	if err != nil {
+		return nil, err
+	}
+	v, err := decodeJSON([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.apply(v)
+}
+
+// errorCode returns the code of err if it is an *apiError.
+func errorCode(err error) string {
+	if apiErr, ok := err.(*apiError); ok {
+		return apiErr.code
+	}
+	return ""
+}
+
+func TestJSONPatch(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		doc   string
+		patch string
+		want  string // the patched doc, or the code of the error
+	}{
+		{"add member", `{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`},
+		{"add replaces member", `{"a":1}`, `[{"op":"add","path":"/a","value":2}]`, `{"a":2}`},
+		{"add to missing parent", `{"a":1}`, `[{"op":"add","path":"/b/c","value":2}]`, "patch_conflict"},
+		{"add inserts element", `{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`},
+		{"add at length", `{"a":[1]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2]}`},
+		{"add appends with -", `{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`},
+		{"add past the end", `{"a":[1]}`, `[{"op":"add","path":"/a/2","value":2}]`, "patch_conflict"},
+		{"add at leading zero index", `{"a":[1,2]}`, `[{"op":"add","path":"/a/01","value":3}]`, "patch_conflict"},
+		{"add whole doc", `{"a":1}`, `[{"op":"add","path":"","value":{"b":2}}]`, `{"b":2}`},
+		{"remove member", `{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`},
+		{"remove element", `{"a":[1,2,3]}`, `[{"op":"remove","path":"/a/1"}]`, `{"a":[1,3]}`},
+		{"remove missing member", `{"a":1}`, `[{"op":"remove","path":"/b"}]`, "patch_conflict"},
+		{"remove with -", `{"a":[1]}`, `[{"op":"remove","path":"/a/-"}]`, "patch_conflict"},
+		{"replace member", `{"a":1}`, `[{"op":"replace","path":"/a","value":"x"}]`, `{"a":"x"}`},
+		{"replace element", `{"a":[1,2]}`, `[{"op":"replace","path":"/a/0","value":0}]`, `{"a":[0,2]}`},
+		{"replace missing member", `{"a":1}`, `[{"op":"replace","path":"/b","value":2}]`, "patch_conflict"},
+		{"replace at length", `{"a":[1]}`, `[{"op":"replace","path":"/a/1","value":2}]`, "patch_conflict"},
+		{"move member", `{"a":1}`, `[{"op":"move","from":"/a","path":"/b"}]`, `{"b":1}`},
+		{"move element", `{"a":[1,2,3]}`, `[{"op":"move","from":"/a/0","path":"/a/-"}]`, `{"a":[2,3,1]}`},
+		{"move missing member", `{"a":1}`, `[{"op":"move","from":"/b","path":"/c"}]`, "patch_conflict"},
+		{"move into itself", `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/b"}]`, "invalid_patch"},
+		{"copy member", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"}]`, `{"a":{"b":1},"c":{"b":1}}`},
+		{"copy is deep", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`},
+		{"copy element", `{"a":[1,2]}`, `[{"op":"copy","from":"/a/1","path":"/a/0"}]`, `{"a":[2,1,2]}`},
+		{"test passes", `{"a":[1,{"b":"x"}]}`, `[{"op":"test","path":"/a","value":[1,{"b":"x"}]}]`, `{"a":[1,{"b":"x"}]}`},
+		{"test compares numbers by value", `{"a":1}`, `[{"op":"test","path":"/a","value":1.0}]`, `{"a":1}`},
+		{"test fails", `{"a":1}`, `[{"op":"test","path":"/a","value":2}]`, "patch_test_failed"},
+		{"test of missing member", `{"a":1}`, `[{"op":"test","path":"/b","value":1}]`, "patch_test_failed"},
+		{"test fails after add", `{"a":1}`, `[{"op":"add","path":"/b","value":2},{"op":"test","path":"/a","value":2}]`, "patch_test_failed"},
+		{"pointer with ~1", `{"a/b":1}`, `[{"op":"replace","path":"/a~1b","value":2}]`, `{"a/b":2}`},
+		{"pointer with ~0", `{"a~b":1}`, `[{"op":"remove","path":"/a~0b"}]`, `{}`},
+		{"pointer with ~01", `{"a~1":1,"a/":2}`, `[{"op":"remove","path":"/a~01"}]`, `{"a/":2}`},
+		{"pointer without /", `{"a":1}`, `[{"op":"remove","path":"a"}]`, "invalid_patch"},
+		{"unknown op", `{"a":1}`, `[{"op":"merge","path":"/a"}]`, "invalid_patch"},
+		{"add without value", `{"a":1}`, `[{"op":"add","path":"/a"}]`, "invalid_patch"},
+		{"not an array", `{"a":1}`, `{"op":"remove","path":"/a"}`, "invalid_patch"},
+	} {
+		got, err := applyPatch(t, jsonPatchType, tt.doc, tt.patch)
+		if err != nil {
+			if code := errorCode(err); code != tt.want {
+				t.Errorf("%s: error %v (%s), want %s", tt.name, err, code, tt.want)
+			}
+			continue
+		}
+		want, err := decodeJSON([]byte(tt.want))
+		if err != nil {
+			t.Errorf("%s: succeeded, want %s", tt.name, tt.want)
+			continue
+		}
+		if !equalValues(got, want) {
+			t.Errorf("%s: got %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// The examples of RFC 7386, appendix A, that patch an object.
+	for _, tt := range []struct {
+		doc   string
+		patch string
+		want  string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		got, err := applyPatch(t, mergePatchType, tt.doc, tt.patch)
+		if err != nil {
+			t.Errorf("%s + %s: %v", tt.doc, tt.patch, err)
+			continue
+		}
+		want, _ := decodeJSON([]byte(tt.want))
+		if !equalValues(got, want) {
+			t.Errorf("%s + %s = %v, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+	if _, err := parsePatch(mergePatchType, []byte(`["a"]`)); errorCode(err) != "invalid_patch" {
+		t.Errorf("array merge patch: %v, want invalid_patch", err)
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	db := newTestDB(t, 10, 10, 100)
+	router := newTestAPI(t, db).newRouter()
+
+	rec := serve(router, "PATCH", "/users/1", `{"email":"merged@example.com"}`, "Content-Type", mergePatchType)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("merge patch: %d %s", rec.Code, rec.Body)
+	}
+	if u := db.getUser(1); u.Email != "merged@example.com" || u.FirstName != "First" {
+		t.Errorf("merge patch left %+v", u)
+	}
+	if etag := rec.Header().Get("ETag"); etag != db.etag(db.getUser(1).Version) {
+		t.Errorf("ETag = %s, want that of the patched user", etag)
+	}
+
+	rec = serve(router, "PATCH", "/users/1", `[
+		{"op":"test","path":"/email","value":"merged@example.com"},
+		{"op":"replace","path":"/first_name","value":"Patched"},
+		{"op":"copy","from":"/first_name","path":"/last_name"}
+	]`, "Content-Type", jsonPatchType+"; charset=utf-8")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("JSON patch: %d %s", rec.Code, rec.Body)
+	}
+	if u := db.getUser(1); u.FirstName != "Patched" || u.LastName != "Patched" {
+		t.Errorf("JSON patch left %+v", u)
+	}
+}
+
+func TestPatchRejected(t *testing.T) {
+	db := newTestDB(t, 10, 10, 100)
+	router := newTestAPI(t, db).newRouter()
+	stale := db.etag(db.getUser(1).Version)
+	serve(router, "PATCH", "/users/1", `{"first_name":"Changed"}`, "Content-Type", mergePatchType)
+	before := *db.getUser(1)
+
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		header      []string
+		status      int
+	}{
+		{"failing test", jsonPatchType, `[{"op":"replace","path":"/email","value":"x@y.z"},{"op":"test","path":"/gender","value":"x"}]`, nil, http.StatusConflict},
+		{"merge removes required field", mergePatchType, `{"email":null}`, nil, http.StatusBadRequest},
+		{"JSON patch removes required field", jsonPatchType, `[{"op":"remove","path":"/birth_date"}]`, nil, http.StatusBadRequest},
+		{"merge changes id", mergePatchType, `{"id":2}`, nil, http.StatusBadRequest},
+		{"JSON patch changes id", jsonPatchType, `[{"op":"replace","path":"/id","value":2}]`, nil, http.StatusBadRequest},
+		{"unknown field", mergePatchType, `{"nickname":"x"}`, nil, http.StatusBadRequest},
+		{"wrong type", mergePatchType, `{"birth_date":"yesterday"}`, nil, http.StatusBadRequest},
+		{"stale If-Match", mergePatchType, `{"email":"x@y.z"}`, []string{"If-Match", stale}, http.StatusPreconditionFailed},
+		{"plain JSON", "application/json", `{"email":"x@y.z"}`, nil, http.StatusUnsupportedMediaType},
+		{"no Content-Type", "", `{"email":"x@y.z"}`, nil, http.StatusUnsupportedMediaType},
+	} {
+		header := append([]string{"Content-Type", tt.contentType}, tt.header...)
+		rec := serve(router, "PATCH", "/users/1", tt.body, header...)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+		accept := rec.Header().Get("Accept-Patch")
+		if tt.status == http.StatusUnsupportedMediaType && accept != mergePatchType+", "+jsonPatchType {
+			t.Errorf("%s: Accept-Patch = %q", tt.name, accept)
+		}
+		if after := *db.getUser(1); after != before {
+			t.Errorf("%s: user changed to %+v", tt.name, after)
+		}
+	}
+
+	current := db.etag(before.Version)
+	rec := serve(router, "PATCH", "/users/1", `{"email":"x@y.z"}`, "Content-Type", mergePatchType, "If-Match", current)
+	if rec.Code != http.StatusOK {
+		t.Errorf("current If-Match: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(router, "PATCH", "/users/1000", `{"email":"x@y.z"}`, "Content-Type", mergePatchType); rec.Code != http.StatusNotFound {
+		t.Errorf("missing user: %d", rec.Code)
+	}
+}
+
+// TestPatchKeepsIndexes patches what the visit indexes and the aggregate
+// queries depend on and checks that they follow.
+func TestPatchKeepsIndexes(t *testing.T) {
+	db := newTestDB(t, 10, 10, 100)
+	router := newTestAPI(t, db).newRouter()
+	patch := func(target string, contentType string, body string) {
+		t.Helper()
+		if rec := serve(router, "PATCH", target, body, "Content-Type", contentType); rec.Code != http.StatusOK {
+			t.Fatalf("PATCH %s: %d %s", target, rec.Code, rec.Body)
+		}
+	}
+
+	// Visit 5 belongs to user 6 and location 6.
+	patch("/visits/5", mergePatchType, `{"user":3,"location":4,"visited_at":2000000000}`)
+	checkVisitIndexes(t, db)
+	for _, v := range db.queryVisits(6, 0, 1<<40, "", 1000) {
+		if v.VisitedAt == 2000000000 {
+			t.Error("visit 5 is still listed for user 6")
+		}
+	}
+	got := db.queryVisits(3, 1999999999, 1<<40, "", 1000)
+	if len(got) != 1 || got[0].Place != "Place 4" {
+		t.Errorf("visits of user 3 after the patch date = %+v, want visit 5 at place 4", got)
+	}
+
+	patch("/visits/5", jsonPatchType, `[{"op":"replace","path":"/user","value":7},{"op":"replace","path":"/visited_at","value":2100000000}]`)
+	checkVisitIndexes(t, db)
+	if got := db.queryVisits(3, 1999999999, 1<<40, "", 1000); len(got) != 0 {
+		t.Errorf("user 3 still has %+v", got)
+	}
+	if got := db.queryVisits(7, 2099999999, 1<<40, "", 1000); len(got) != 1 {
+		t.Errorf("user 7 has %+v after the patch date, want visit 5", got)
+	}
+
+	// Patching the location and the user changes what the queries filter.
+	patch("/locations/4", mergePatchType, `{"country":"Патчленд"}`)
+	if got := db.queryVisits(7, 2099999999, 1<<40, "Патчленд", 1000); len(got) != 1 {
+		t.Errorf("visits of user 7 in the patched country = %+v, want visit 5", got)
+	}
+	patch("/users/7", jsonPatchType, `[{"op":"replace","path":"/gender","value":"f"}]`)
+	if avg := db.queryAverage(4, 2099999999, 1<<40, 0, 1000, "f"); avg != float64(db.getVisit(5).Mark) {
+		t.Errorf("average of location 4 for women after the patch date = %v, want the mark of visit 5", avg)
+	}
+	checkVisitIndexes(t, db)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPutCreates(t *testing.T) {
+	db := newTestDB(t, 10, 10, 10)
+	router := newTestAPI(t, db).newRouter()
+
+	tests := []struct {
+		target string
+		body   string
+		stored func() bool
+	}{
+		{"/users/20", `{"email":"new@example.com","first_name":"New","last_name":"User","gender":"f","birth_date":0}`,
+			func() bool { u := db.getUser(20); return u != nil && u.Email == "new@example.com" && u.Version == 1 }},
+		{"/locations/20", `{"id":20,"place":"New","country":"Nowhere","city":"City","distance":5}`,
+			func() bool { l := db.getLocation(20); return l != nil && l.Country == "Nowhere" && l.Version == 1 }},
+		{"/visits/20", `{"user":2,"location":3,"visited_at":5000,"mark":4}`,
+			func() bool { v := db.getVisit(20); return v != nil && v.User == 2 && v.Location == 3 && v.Version == 1 }},
+	}
+	for _, tt := range tests {
+		rec := serve(router, "PUT", tt.target, tt.body)
+		if rec.Code != http.StatusCreated {
+			t.Errorf("PUT %s: %d %s, want %d", tt.target, rec.Code, rec.Body, http.StatusCreated)
+			continue
+		}
+		if location := rec.Header().Get("Location"); location != tt.target {
+			t.Errorf("PUT %s: Location %q", tt.target, location)
+		}
+		if rec.Header().Get("ETag") == "" {
+			t.Errorf("PUT %s: no ETag", tt.target)
+		}
+		if !tt.stored() {
+			t.Errorf("PUT %s: not stored as sent", tt.target)
+		}
+	}
+	checkVisitIndexes(t, db)
+}
+
+func TestPutReplaces(t *testing.T) {
+	db := newTestDB(t, 10, 10, 10)
+	router := newTestAPI(t, db).newRouter()
+	old := db.getUser(1)
+
+	rec := serve(router, "PUT", "/users/1", `{"id":1,"email":"new@example.com","first_name":"New","last_name":"Name","gender":"f","birth_date":123}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s, want %d", rec.Code, rec.Body, http.StatusOK)
+	}
+	if location := rec.Header().Get("Location"); location != "" {
+		t.Errorf("replacement with Location %q", location)
+	}
+	want := User{ID: 1, Email: "new@example.com", FirstName: "New", LastName: "Name", Gender: "f", BirthDate: 123, Version: old.Version + 1}
+	if user := db.getUser(1); *user != want {
+		t.Errorf("user 1 = %+v, want %+v", *user, want)
+	}
+	if etag := rec.Header().Get("ETag"); etag != db.etag(want.Version) {
+		t.Errorf("ETag %s, want %s", etag, db.etag(want.Version))
+	}
+}
+
+func TestPutValidates(t *testing.T) {
+	db := newTestDB(t, 10, 10, 10)
+	router := newTestAPI(t, db).newRouter()
+	user := `{"email":"new@example.com","first_name":"New","last_name":"User","gender":"f","birth_date":0}`
+	location := `{"place":"New","country":"Nowhere","city":"City","distance":5}`
+	visit := `{"user":2,"location":3,"visited_at":5000,"mark":4}`
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		code   string
+	}{
+		{"user without email", "/users/1", strings.Replace(user, `"email":"new@example.com",`, "", 1), "missing_field"},
+		{"new user without birth_date", "/users/20", strings.Replace(user, `,"birth_date":0`, "", 1), "missing_field"},
+		{"user with null gender", "/users/1", strings.Replace(user, `"f"`, "null", 1), ""},
+		{"location without place", "/locations/1", strings.Replace(location, `"place":"New",`, "", 1), "missing_field"},
+		{"visit without mark", "/visits/1", strings.Replace(visit, `,"mark":4`, "", 1), "missing_field"},
+		{"visit without user", "/visits/20", strings.Replace(visit, `"user":2,`, "", 1), "missing_field"},
+		{"other id", "/users/1", strings.Replace(user, `{`, `{"id":2,`, 1), "invalid_field"},
+	}
+	for _, tt := range tests {
+		rec := serve(router, "PUT", tt.target, tt.body)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, http.StatusBadRequest)
+		}
+		if tt.code != "" && !strings.Contains(rec.Body.String(), `"code":"`+tt.code+`"`) {
+			t.Errorf("%s: %s, want code %s", tt.name, rec.Body, tt.code)
+		}
+	}
+	if db.getUser(1).Version != 1 || db.getLocation(1).Version != 1 || db.getVisit(1).Version != 1 {
+		t.Error("an invalid PUT was applied")
+	}
+	if db.getUser(20) != nil || db.getVisit(20) != nil {
+		t.Error("an invalid PUT created an entity")
+	}
+}
+
+func TestPutMovesVisit(t *testing.T) {
+	db := newTestDB(t, 10, 10, 10)
+	router := newTestAPI(t, db).newRouter()
+	// Visit 5 belongs to user 6 and location 6.
+	old := db.getVisit(5)
+
+	rec := serve(router, "PUT", "/visits/5", `{"user":2,"location":3,"visited_at":5000,"mark":4}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body)
+	}
+	checkVisitIndexes(t, db)
+	s := db.visits.load()
+	if containsInt32(s.visitsByUser.get(old.User), 5) || containsInt32(s.visitsByLocation.get(old.Location), 5) {
+		t.Error("visit 5 is still listed under its old user or location")
+	}
+	if !containsInt32(s.visitsByUser.get(2), 5) || !containsInt32(s.visitsByLocation.get(3), 5) {
+		t.Error("visit 5 is not listed under its new user and location")
+	}
+
+	rec = serve(router, "GET", "/users/2/visits?toDate=6000", "")
+	if body := rec.Body.String(); rec.Code != http.StatusOK || !strings.Contains(body, `"visited_at":5000`) {
+		t.Errorf("visits of user 2: %d %s", rec.Code, body)
+	}
+	rec = serve(router, "GET", "/users/6/visits?toDate=6000", "")
+	if body := rec.Body.String(); rec.Code != http.StatusOK || strings.Contains(body, `"visited_at":5000`) {
+		t.Errorf("visits of user 6: %d %s", rec.Code, body)
+	}
+}
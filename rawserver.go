@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// rawBufferSize is the initial size of a connection's read buffer. Contest
+// requests are a few hundred bytes, so most connections never grow it.
+const rawBufferSize = 4096
+
+// rawMaxRequestSize bounds the header and the body of a request, each.
+const rawMaxRequestSize = 1 << 20
+
+// A connection is closed when no request starts within rawIdleTimeout, or
+// when a started request is not complete within rawReadTimeout.
+const (
+	rawIdleTimeout = 5 * time.Minute
+	rawReadTimeout = 10 * time.Second
+)
+
+var (
+	errRawMalformed = errors.New("malformed request")
+	errRawTooLarge  = errors.New("request too large")
+)
+
+var rawBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, rawBufferSize)
+		return &b
+	},
+}
+
+var rawWriterPool = sync.Pool{
+	New: func() interface{} {
+		return &rawResponseWriter{header: make(http.Header)}
+	},
+}
+
+// rawServer is a minimal HTTP/1.1 server for the contest load: small
+// keep-alive requests with Content-Length bodies. Requests are read into a
+// pooled buffer and dispatched with a hand-rolled matcher over the same
+// route table and handlers as the net/http engine. Bodies are served from
+// the buffer without copying; the request line and the headers are copied
+// into the strings of the http.Request that the handlers take.
+type rawServer struct {
+	routes           []rawRoute
+	notFound         http.Handler
+	methodNotAllowed http.Handler
+
+	mux          sync.Mutex
+	listeners    map[net.Listener]struct{}
+	conns        map[net.Conn]bool // true while the connection is idle
+	shuttingDown int32
+}
+
+// rawRoute is a route split into path segments. A segment is a variable
+// when its name is not empty.
+type rawRoute struct {
+	method   string
+	segments []string
+	names    []string
+	handler  http.Handler
+}
+
+func newRawServer(a *api) *rawServer {
+	s := &rawServer{
+		notFound:         a.build(a.notFoundRoute()),
+		methodNotAllowed: a.build(a.methodNotAllowedRoute()),
+		listeners:        make(map[net.Listener]struct{}),
+		conns:            make(map[net.Conn]bool),
+	}
+	for _, rt := range a.routes() {
+		segments := strings.Split(strings.TrimPrefix(rt.template, "/"), "/")
+		names := make([]string, len(segments))
+		for i, seg := range segments {
+			if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+				names[i] = seg[1 : len(seg)-1]
+			}
+		}
+		s.routes = append(s.routes, rawRoute{
+			method:   rt.method,
+			segments: segments,
+			names:    names,
+			handler:  a.build(rt),
+		})
+	}
+	return s
+}
+
+// match returns the first route whose template matches path, together with
+// its path variables. Like gorilla/mux, a path that only matches routes of
+// other methods is reported with methodMismatch.
+func (s *rawServer) match(method string, path string) (rt *rawRoute, vars map[string]string, methodMismatch bool) {
+	if len(path) == 0 || path[0] != '/' {
+		return nil, nil, false
+	}
+	path = path[1:]
+	for i := range s.routes {
+		candidate := &s.routes[i]
+		if !candidate.matchPath(path) {
+			continue
+		}
+		if candidate.method != method {
+			methodMismatch = true
+			continue
+		}
+		return candidate, candidate.vars(path), false
+	}
+	return nil, nil, methodMismatch
+}
+
+func (rt *rawRoute) matchPath(path string) bool {
+	for i, seg := range rt.segments {
+		end := strings.IndexByte(path, '/')
+		last := i == len(rt.segments)-1
+		if last != (end < 0) {
+			return false
+		}
+		part := path
+		if !last {
+			part = path[:end]
+			path = path[end+1:]
+		}
+		if rt.names[i] == "" {
+			if part != seg {
+				return false
+			}
+		} else if len(part) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (rt *rawRoute) vars(path string) map[string]string {
+	vars := make(map[string]string, 1)
+	for i := range rt.segments {
+		part := path
+		if end := strings.IndexByte(path, '/'); end >= 0 {
+			part = path[:end]
+			path = path[end+1:]
+		}
+		if rt.names[i] != "" {
+			vars[rt.names[i]] = part
+		}
+	}
+	return vars
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections
+// until the listener fails.
+func (s *rawServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln and serves each of them in its own
+// goroutine. Like http.Server, it returns http.ErrServerClosed once
+// Shutdown has been called.
+func (s *rawServer) Serve(ln net.Listener) error {
+	s.mux.Lock()
+	s.listeners[ln] = struct{}{}
+	s.mux.Unlock()
+	defer func() {
+		s.mux.Lock()
+		delete(s.listeners, ln)
+		s.mux.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isShuttingDown() {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		s.setIdle(conn, true)
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections, closes idle ones and waits for the
+// requests in flight to finish, or for ctx to be done.
+func (s *rawServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+
+	s.mux.Lock()
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mux.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *rawServer) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) != 0
+}
+
+// closeIdleConns closes every idle connection and reports whether no
+// connection is left.
+func (s *rawServer) closeIdleConns() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *rawServer) setIdle(conn net.Conn, idle bool) {
+	s.mux.Lock()
+	s.conns[conn] = idle
+	s.mux.Unlock()
+}
+
+func (s *rawServer) forget(conn net.Conn) {
+	s.mux.Lock()
+	delete(s.conns, conn)
+	s.mux.Unlock()
+}
+
+func (s *rawServer) serveConn(conn net.Conn) {
+	defer s.forget(conn)
+	defer conn.Close()
+
+	// buf may be replaced by a larger one for big requests; only the
+	// original pooled buffer goes back to the pool.
+	bufp := rawBufferPool.Get().(*[]byte)
+	defer rawBufferPool.Put(bufp)
+	buf := *bufp
+	out := bufio.NewWriter(conn)
+
+	// A panicking handler costs its connection, not the process. The
+	// response it was writing is discarded with the pooled writer; out only
+	// holds complete responses to earlier pipelined requests.
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("panic serving %s: %v\n%s", conn.RemoteAddr(), v, debug.Stack())
+			rawWriteStatus(out, http.StatusInternalServerError)
+		}
+	}()
+
+	n := 0
+	for {
+		// Pipelined bytes are the start of a request already.
+		if n == 0 {
+			conn.SetReadDeadline(time.Now().Add(rawIdleTimeout))
+		} else {
+			conn.SetReadDeadline(time.Now().Add(rawReadTimeout))
+		}
+		headerEnd, err := rawReadUntil(conn, &buf, &n, rawMaxRequestSize, func(b []byte) int {
+			if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+				return i + 4
+			}
+			return -1
+		})
+		if err != nil {
+			// Nothing is owed to a client that never started a request.
+			if n > 0 && !s.isShuttingDown() {
+				rawWriteStatus(out, rawErrorStatus(err, http.StatusRequestHeaderFieldsTooLarge))
+			}
+			return
+		}
+		s.setIdle(conn, false)
+
+		req, keepAlive, err := rawParseHeader(buf[:headerEnd])
+		if err != nil {
+			rawWriteStatus(out, rawErrorStatus(err, http.StatusRequestEntityTooLarge))
+			return
+		}
+		total := headerEnd + int(req.ContentLength)
+		conn.SetReadDeadline(time.Now().Add(rawReadTimeout))
+		_, err = rawReadUntil(conn, &buf, &n, total, func(b []byte) int {
+			if len(b) >= total {
+				return total
+			}
+			return -1
+		})
+		if err != nil {
+			rawWriteStatus(out, rawErrorStatus(err, http.StatusRequestEntityTooLarge))
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(buf[headerEnd:total]))
+		req.RemoteAddr = conn.RemoteAddr().String()
+		if s.isShuttingDown() {
+			keepAlive = false
+		}
+
+		s.serveRequest(out, req, keepAlive)
+
+		// Keep any pipelined bytes and only flush once the client is
+		// waiting for us.
+		n = copy(buf, buf[total:n])
+		if n == 0 || !keepAlive {
+			if err := out.Flush(); err != nil {
+				return
+			}
+		}
+		if !keepAlive {
+			return
+		}
+		s.setIdle(conn, n == 0)
+	}
+}
+
+// rawErrorStatus returns the status that answers a request that could not
+// be read because of err. tooLarge is the status for errRawTooLarge.
+func rawErrorStatus(err error, tooLarge int) int {
+	if err == errRawTooLarge {
+		return tooLarge
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return http.StatusRequestTimeout
+	}
+	return http.StatusBadRequest
+}
+
+// rawReadUntil reads from conn into *buf until done reports the length of a
+// complete message in the first *n bytes, growing the buffer up to limit
+// bytes if needed.
+func rawReadUntil(conn net.Conn, buf *[]byte, n *int, limit int, done func([]byte) int) (int, error) {
+	for {
+		if end := done((*buf)[:*n]); end >= 0 {
+			return end, nil
+		}
+		if *n == len(*buf) {
+			if len(*buf) >= limit {
+				return 0, errRawTooLarge
+			}
+			size := 2 * len(*buf)
+			if size > limit {
+				size = limit
+			}
+			grown := make([]byte, size)
+			copy(grown, (*buf)[:*n])
+			*buf = grown
+		}
+		m, err := conn.Read((*buf)[*n:])
+		*n += m
+		if err != nil {
+			if err == io.EOF && *n > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+}
+
+// rawParseHeader parses the request line and headers. The body is attached
+// by the caller once it has been read.
+func rawParseHeader(b []byte) (*http.Request, bool, error) {
+	lineEnd := bytes.Index(b, []byte("\r\n"))
+	if lineEnd < 0 {
+		return nil, false, errRawMalformed
+	}
+	line := b[:lineEnd]
+	sp1 := bytes.IndexByte(line, ' ')
+	sp2 := bytes.LastIndexByte(line, ' ')
+	if sp1 <= 0 || sp2 <= sp1 {
+		return nil, false, errRawMalformed
+	}
+	method := rawMethod(line[:sp1])
+	target := string(line[sp1+1 : sp2])
+	proto := string(line[sp2+1:])
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return nil, false, errRawMalformed
+	}
+
+	path, rawQuery := target, ""
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		path, rawQuery = target[:i], target[i+1:]
+	}
+	if strings.IndexByte(path, '%') >= 0 {
+		unescaped, err := url.PathUnescape(path)
+		if err != nil {
+			return nil, false, errRawMalformed
+		}
+		path = unescaped
+	}
+
+	header := make(http.Header)
+	contentLength := int64(-1)
+	keepAlive := major == 1 && minor >= 1
+	rest := b[lineEnd+2:]
+	for {
+		end := bytes.Index(rest, []byte("\r\n"))
+		if end <= 0 {
+			break
+		}
+		field := rest[:end]
+		rest = rest[end+2:]
+		colon := bytes.IndexByte(field, ':')
+		if colon <= 0 {
+			return nil, false, errRawMalformed
+		}
+		key := http.CanonicalHeaderKey(string(bytes.TrimSpace(field[:colon])))
+		value := string(bytes.TrimSpace(field[colon+1:]))
+		header.Add(key, value)
+		switch key {
+		case "Content-Length":
+			length, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || length < 0 {
+				return nil, false, errRawMalformed
+			}
+			// Repeated lengths that disagree leave the body's end open
+			// to interpretation, which request smuggling relies on.
+			if contentLength >= 0 && length != contentLength {
+				return nil, false, errRawMalformed
+			}
+			if length > rawMaxRequestSize {
+				return nil, false, errRawTooLarge
+			}
+			contentLength = length
+		case "Connection":
+			if strings.EqualFold(value, "close") {
+				keepAlive = false
+			} else if strings.EqualFold(value, "keep-alive") {
+				keepAlive = true
+			}
+		case "Transfer-Encoding":
+			// Chunked bodies never occur in the contest load.
+			return nil, false, errRawMalformed
+		}
+	}
+
+	if contentLength < 0 {
+		contentLength = 0
+	}
+	req := &http.Request{
+		Method:        method,
+		URL:           &url.URL{Path: path, RawQuery: rawQuery},
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		ContentLength: contentLength,
+		Host:          header.Get("Host"),
+		RequestURI:    target,
+		Close:         !keepAlive,
+	}
+	return req, keepAlive, nil
+}
+
+// rawMethod returns b as a string, without allocating for the methods of
+// the routes.
+func rawMethod(b []byte) string {
+	for _, method := range [...]string{"GET", "POST", "PUT", "PATCH"} {
+		if string(b) == method {
+			return method
+		}
+	}
+	return string(b)
+}
+
+func (s *rawServer) serveRequest(out *bufio.Writer, req *http.Request, keepAlive bool) {
+	w := rawWriterPool.Get().(*rawResponseWriter)
+	defer func() {
+		w.reset()
+		rawWriterPool.Put(w)
+	}()
+
+	rt, vars, methodMismatch := s.match(req.Method, req.URL.Path)
+	switch {
+	case rt != nil:
+		rt.handler.ServeHTTP(w, mux.SetURLVars(req, vars))
+	case methodMismatch:
+		s.methodNotAllowed.ServeHTTP(w, req)
+	default:
+		s.notFound.ServeHTTP(w, req)
+	}
+
+	if err := w.writeTo(out, keepAlive); err != nil {
+		logRequestError(req, "write response", err)
+	}
+}
+
+func rawWriteStatus(out *bufio.Writer, status int) {
+	w := &rawResponseWriter{header: make(http.Header)}
+	w.WriteHeader(status)
+	if err := w.writeTo(out, false); err == nil {
+		out.Flush()
+	}
+}
+
+// rawResponseWriter buffers a whole response so it can be sent with a
+// Content-Length header.
+type rawResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *rawResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *rawResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *rawResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *rawResponseWriter) reset() {
+	for k := range w.header {
+		delete(w.header, k)
+	}
+	w.status = 0
+	w.body.Reset()
+}
+
+func (w *rawResponseWriter) writeTo(out *bufio.Writer, keepAlive bool) error {
+	w.WriteHeader(http.StatusOK)
+	out.WriteString("HTTP/1.1 ")
+	out.WriteString(strconv.Itoa(w.status))
+	out.WriteByte(' ')
+	out.WriteString(http.StatusText(w.status))
+	out.WriteString("\r\n")
+	for key, values := range w.header {
+		switch key {
+		case "Content-Length", "Transfer-Encoding", "Connection":
+			continue
+		}
+		for _, value := range values {
+			out.WriteString(key)
+			out.WriteString(": ")
+			out.WriteString(value)
+			out.WriteString("\r\n")
+		}
+	}
+	out.WriteString("Content-Length: ")
+	out.WriteString(strconv.Itoa(w.body.Len()))
+	if keepAlive {
+		out.WriteString("\r\nConnection: keep-alive\r\n\r\n")
+	} else {
+		out.WriteString("\r\nConnection: close\r\n\r\n")
+	}
+	_, err := out.Write(w.body.Bytes())
+	return err
+}
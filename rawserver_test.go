@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// startRawServer serves the routes of a test database, and /panic, on a
+// local port and returns its address.
+func startRawServer(t *testing.T) (string, func()) {
+	t.Helper()
+	s := newRawServer(newTestAPI(t, newTestDB(t, 10, 10, 10)))
+	s.routes = append(s.routes, rawRoute{
+		method:   "GET",
+		segments: []string{"panic"},
+		names:    []string{""},
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("partial"))
+			panic("handler bug")
+		}),
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+// rawRoundTrip sends raw on a new connection and returns the status of the
+// first response.
+func rawRoundTrip(t *testing.T, addr string, raw string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRawServerStatuses(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	addr, stop := startRawServer(t)
+	defer stop()
+
+	tests := []struct {
+		name string
+		raw  string
+		want int
+	}{
+		{"get", "GET /users/1 HTTP/1.1\r\nHost: x\r\n\r\n", http.StatusOK},
+		{"panic", "GET /panic HTTP/1.1\r\nHost: x\r\n\r\n", http.StatusInternalServerError},
+		{"body too large", fmt.Sprintf("POST /users/new HTTP/1.1\r\nHost: x\r\nContent-Length: %d\r\n\r\n", rawMaxRequestSize+1), http.StatusRequestEntityTooLarge},
+		{"get after panic", "GET /users/2 HTTP/1.1\r\nHost: x\r\n\r\n", http.StatusOK},
+		// Exactly the limit, so the server reads all of it before answering.
+		{"header too large", "GET / HTTP/1.1\r\nX: " + strings.Repeat("a", rawMaxRequestSize-len("GET / HTTP/1.1\r\nX: ")), http.StatusRequestHeaderFieldsTooLarge},
+		{"malformed", "GET\r\n\r\n", http.StatusBadRequest},
+		{"conflicting lengths", "POST /users/1 HTTP/1.1\r\nHost: x\r\nContent-Length: 12\r\nContent-Length: 2\r\n\r\n{}", http.StatusBadRequest},
+		{"repeated length", "POST /users/1 HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\n{}", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := rawRoundTrip(t, addr, tt.raw); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
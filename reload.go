@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadStatus describes the running or the last finished reload. State is
+// "idle", "running", "succeeded" or "failed".
+type reloadStatus struct {
+	State      string `json:"state"`
+	Path       string `json:"path,omitempty"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	Users      int    `json:"users,omitempty"`
+	Locations  int    `json:"locations,omitempty"`
+	Visits     int    `json:"visits,omitempty"`
+}
+
+// reloader allows one reload at a time.
+var reloader = struct {
+	mu     sync.Mutex
+	status reloadStatus
+}{
+	status: reloadStatus{State: "idle"},
+}
+
+var errReloadRunning = &apiError{
+	status:  http.StatusConflict,
+	code:    "reload_running",
+	message: "a reload is already running",
+}
+
+// errReloadPath does not tell why a path was refused, so the endpoint
+// cannot be used to probe the file system.
+var errReloadPath = errInvalidField("path", "must name a data source inside the admin root")
+
+// errReloadJournalFull fails a reload during which more writes were made
+// than the journal keeps, since the new data would lose some of them.
+var errReloadJournalFull = errors.New("more writes during the reload than admin.reload_journal keeps")
+
+// resolveDataPath returns the absolute path of the data source p, which is
+// relative to root unless it is absolute. The path, after following
+// symlinks, must exist and lie inside root.
+func resolveDataPath(root string, p string) (string, error) {
+	for _, elem := range strings.Split(filepath.ToSlash(p), "/") {
+		if elem == ".." {
+			return "", errReloadPath
+		}
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", errReloadPath
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(root, p)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", errReloadPath
+	}
+	realPath, err := filepath.EvalSymlinks(filepath.Clean(p))
+	if err != nil {
+		return "", errReloadPath
+	}
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errReloadPath
+	}
+	return realPath, nil
+}
+
+// startReload loads the data source at dataPath into a new database in the
+// background and makes it live once it is complete. Requests are served
+// from the old database until then, and the writes made to it in the
+// meantime are replayed onto the new one before the swap. A failed reload
+// leaves the live database untouched.
+func (a *api) startReload(dataPath string) (reloadStatus, error) {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	if reloader.status.State == "running" {
+		return reloader.status, errReloadRunning
+	}
+	if dataPath == "-" {
+		return reloader.status, errInvalidField("path", "stdin can only be loaded at startup")
+	}
+	if dataPath != a.config.DataDir {
+		resolved, err := resolveDataPath(a.config.adminRoot(), dataPath)
+		if err != nil {
+			return reloader.status, err
+		}
+		dataPath = resolved
+	} else if _, err := os.Stat(dataPath); err != nil {
+		log.Println("Cannot reload", dataPath+":", err)
+		return reloader.status, errReloadPath
+	}
+
+	reloader.status = reloadStatus{
+		State:     "running",
+		Path:      dataPath,
+		StartedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	// The writes to the old database are journaled from now on, so none
+	// that is made after the reload was accepted is lost with it.
+	changeFeed.startJournal(a.config.Admin.ReloadJournal)
+	go a.runReload(dataPath)
+	return reloader.status, nil
+}
+
+func (a *api) runReload(dataPath string) {
+	start := time.Now()
+	log.Println("Reloading", dataPath)
+
+	db := newInmemoryDB(a.config.BTreeDegree, a.config.AgeReference, a.config.HistoryLimit, a.config.HistoryEntities)
+	err := loadData(db, dataPath, a.config.LoadPolicy, nil)
+	if err == nil {
+		// The ammo replay would run against the old database, which is
+		// still the live one, so only the trees are warmed up.
+		if a.config.Warmup.Enabled {
+			warmUp(db, "", nil)
+		}
+		writeGate.Lock()
+		events, ok := changeFeed.stopJournal()
+		if ok {
+			replayed := replayEvents(db, events)
+			db.attachFeed(changeFeed)
+			liveDB.Store(db)
+			writeGate.Unlock()
+			if replayed > 0 {
+				log.Println("Replayed", replayed, "writes made during the reload")
+			}
+		} else {
+			writeGate.Unlock()
+			err = errReloadJournalFull
+		}
+	} else {
+		changeFeed.stopJournal()
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloader.status.FinishedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	if err != nil {
+		// The error may quote the data source, so it only goes to the log.
+		reloader.status.State = "failed"
+		reloader.status.Error = "loading the data source failed, see the server log"
+		if err == errReloadJournalFull {
+			reloader.status.Error = err.Error()
+		}
+		log.Println("Reload of", dataPath, "failed:", err)
+		return
+	}
+	reloader.status.State = "succeeded"
+	reloader.status.Users, reloader.status.Locations, reloader.status.Visits = db.counts()
+	log.Println("Reloaded", dataPath, "in", time.Since(start))
+}
+
+// replayEvents applies the writes of events to db, which is not live yet,
+// and returns how many it applied. Created and updated entities are stored
+// with the state they were given by the write.
+func replayEvents(db *InmemoryDB, events []changeEvent) int {
+	replayed := 0
+	for _, e := range events {
+		var err error
+		switch {
+		case e.Type == eventDelete && e.Entity == "users":
+			db.removeUser(e.Key)
+		case e.Type == eventDelete && e.Entity == "locations":
+			db.removeLocation(e.Key)
+		case e.Type == eventDelete && e.Entity == "visits":
+			db.removeVisit(e.Key)
+		case e.Entity == "users":
+			var user User
+			if err = json.Unmarshal(e.Data, &user); err == nil {
+				db.loadUsers([]*User{&user}, true)
+			}
+		case e.Entity == "locations":
+			var location Location
+			if err = json.Unmarshal(e.Data, &location); err == nil {
+				db.loadLocations([]*Location{&location}, true)
+			}
+		case e.Entity == "visits":
+			var visit Visit
+			if err = json.Unmarshal(e.Data, &visit); err == nil {
+				db.loadVisits([]*Visit{&visit}, true)
+			}
+		}
+		if err != nil {
+			log.Println("WARNING: write not replayed:", err)
+			continue
+		}
+		replayed++
+	}
+	return replayed
+}
+
+// watchReloadSignal reloads the startup data source on SIGHUP.
+func (a *api) watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if _, err := a.startReload(a.config.DataDir); err != nil {
+				log.Println("Ignoring SIGHUP:", err)
+			}
+		}
+	}()
+}
+
+func writeReloadStatus(w http.ResponseWriter, r *http.Request, status int, s reloadStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(s)
+	if err != nil {
+		logRequestError(r, "encode response", err)
+	}
+}
+
+func (a *api) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	dataPath := r.URL.Query().Get("path")
+	if dataPath == "" {
+		dataPath = a.config.DataDir
+	}
+	s, err := a.startReload(dataPath)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	writeReloadStatus(w, r, http.StatusAccepted, s)
+}
+
+func (a *api) reloadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	reloader.mu.Lock()
+	s := reloader.status
+	reloader.mu.Unlock()
+	writeReloadStatus(w, r, http.StatusOK, s)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveDataPath(t *testing.T) {
+	root, cleanup := tempDir(t)
+	defer cleanup()
+	outside, cleanupOutside := tempDir(t)
+	defer cleanupOutside()
+	for _, p := range []string{
+		filepath.Join(root, "inside.json"),
+		filepath.Join(root, "sub", "nested.json"),
+		filepath.Join(outside, "secret.json"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.json"), filepath.Join(root, "escape.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "inside.json"), filepath.Join(root, "alias.json")); err != nil {
+		t.Fatal(err)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string // relative to root, empty if the path is refused
+	}{
+		{"inside.json", "inside.json"},
+		{"sub/nested.json", filepath.Join("sub", "nested.json")},
+		{filepath.Join(root, "inside.json"), "inside.json"},
+		{"alias.json", "inside.json"},
+		{".", "."},
+		{"missing.json", ""},
+		{"../secret.json", ""},
+		{"sub/../inside.json", ""},
+		{filepath.Join(root, "..", filepath.Base(outside), "secret.json"), ""},
+		{filepath.Join(outside, "secret.json"), ""},
+		{"escape.json", ""},
+		{"escape/secret.json", ""},
+	}
+	for _, tt := range tests {
+		got, err := resolveDataPath(root, tt.path)
+		if tt.want == "" {
+			if err != errReloadPath {
+				t.Errorf("resolveDataPath(%q) = %q, %v; want %v", tt.path, got, err, errReloadPath)
+			}
+			continue
+		}
+		if want := filepath.Join(realRoot, tt.want); err != nil || got != want {
+			t.Errorf("resolveDataPath(%q) = %q, %v; want %q", tt.path, got, err, want)
+		}
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	a := newTestAPI(t, newTestDB(t, 1, 1, 1))
+	router := a.newRouter()
+
+	if rec := serve(router, "GET", "/admin/reload", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("without a configured token: %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	a.config.Admin.Token = "secret"
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secre", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := serve(router, "GET", "/admin/reload", "", "Authorization", tt.authorization)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q: %d, want %d", tt.authorization, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q: no WWW-Authenticate challenge", tt.authorization)
+		}
+	}
+}
+
+// writeUsersFile writes users as a data directory for reloads.
+func writeUsersFile(t *testing.T, dir string, users []*User) {
+	t.Helper()
+	b, err := json.Marshal(map[string][]*User{"users": users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "users_1.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForReload waits until the running reload has finished and returns
+// its status.
+func waitForReload() reloadStatus {
+	for {
+		reloader.mu.Lock()
+		s := reloader.status
+		reloader.mu.Unlock()
+		if s.State != "running" {
+			return s
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// startTestReload starts a reload of dir while the write gate is held
+// shared, so the reload cannot swap the databases before write has run on
+// the old one.
+func startTestReload(t *testing.T, a *api, dir string, write func(db *InmemoryDB)) reloadStatus {
+	t.Helper()
+	writeGate.RLock()
+	if _, err := a.startReload(dir); err != nil {
+		writeGate.RUnlock()
+		t.Fatal(err)
+	}
+	write(currentDB())
+	writeGate.RUnlock()
+	return waitForReload()
+}
+
+func TestReloadReplaysWrites(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	writeUsersFile(t, dir, testUsers(1, 2))
+	old := newTestDB(t, 3, 0, 0)
+	old.attachFeed(changeFeed)
+	a := newTestAPI(t, old)
+	a.config.DataDir = dir
+
+	s := startTestReload(t, a, dir, func(db *InmemoryDB) {
+		db.addUsers(testUsers(100, 1))
+		email := "changed@example.com"
+		db.updateUser(1, &UserUpdate{Email: &email}, "")
+	})
+	if s.State != "succeeded" {
+		t.Fatalf("reload %s: %s", s.State, s.Error)
+	}
+	db := currentDB()
+	if db == old {
+		t.Fatal("the reloaded database is not live")
+	}
+	if db.getUser(100) == nil {
+		t.Error("user 100, created during the reload, was lost")
+	}
+	if user := db.getUser(1); user == nil || user.Email != "changed@example.com" {
+		t.Errorf("user 1, updated during the reload: %+v", user)
+	}
+	if db.getUser(3) != nil {
+		t.Error("user 3, which is not in the data source, survived the reload")
+	}
+}
+
+func TestReloadFailsOnJournalOverflow(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	writeUsersFile(t, dir, testUsers(1, 2))
+	old := newTestDB(t, 3, 0, 0)
+	old.attachFeed(changeFeed)
+	a := newTestAPI(t, old)
+	a.config.DataDir = dir
+	a.config.Admin.ReloadJournal = 1
+
+	s := startTestReload(t, a, dir, func(db *InmemoryDB) {
+		db.addUsers(testUsers(100, 2))
+	})
+	if s.State != "failed" || s.Error != errReloadJournalFull.Error() {
+		t.Errorf("reload %s: %s; want failed: %v", s.State, s.Error, errReloadJournalFull)
+	}
+	if currentDB() != old {
+		t.Error("the failed reload replaced the live database")
+	}
+	if old.getUser(101) == nil {
+		t.Error("a write during the failed reload was lost")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// replayPhases are the ammo files of test_data.zip in the order the contest
+// fired them. Later phases depend on the writes of phase 2.
+var replayPhases = []string{"phase_1_get", "phase_2_post", "phase_3_get"}
+
+// ammoRequest is one raw HTTP request of a tank ammo file.
+type ammoRequest struct {
+	tag string
+	raw []byte
+}
+
+// ammoAnswer is the expected response of an ammo request. body is empty
+// when the answer file does not record one.
+type ammoAnswer struct {
+	method string
+	uri    string
+	status int
+	body   string
+}
+
+// readAmmo parses the "<size> <tag>\n<request>" records of an ammo file.
+func readAmmo(r io.Reader) ([]ammoRequest, error) {
+	br := bufio.NewReader(r)
+	var requests []ammoRequest
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && len(line) == 0 {
+			return requests, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		size, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad ammo header %q", line)
+		}
+		raw := make([]byte, size)
+		if _, err := io.ReadFull(br, raw); err != nil {
+			return nil, err
+		}
+		request := ammoRequest{raw: raw}
+		if len(fields) > 1 {
+			request.tag = fields[1]
+		}
+		requests = append(requests, request)
+	}
+}
+
+// readAnswers parses the tab separated lines of an answers file.
+func readAnswers(r io.Reader) ([]ammoAnswer, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var answers []ammoAnswer
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("bad answer line %q", scanner.Text())
+		}
+		status, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("bad answer status %q", parts[2])
+		}
+		answer := ammoAnswer{method: parts[0], uri: parts[1], status: status}
+		if len(parts) == 4 {
+			answer.body = parts[3]
+		}
+		answers = append(answers, answer)
+	}
+	return answers, scanner.Err()
+}
+
+// matches reports whether a response agrees with the answer. Bodies are
+// compared as JSON since key order and escaping differ between servers.
+func (a *ammoAnswer) matches(status int, body []byte) bool {
+	if a.status != status {
+		return false
+	}
+	if len(a.body) == 0 {
+		return true
+	}
+	var expected, actual interface{}
+	if err := json.Unmarshal([]byte(a.body), &expected); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(body, &actual); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(expected, actual)
+}
+
+func readZipFile(r *zip.Reader, name string) (io.ReadCloser, error) {
+	for _, f := range r.File {
+		if f.Name == name {
+			return f.Open()
+		}
+	}
+	return nil, fmt.Errorf("%s not found", name)
+}
+
+// loadPhase reads the ammo and answers of one phase from test_data.zip.
+func loadPhase(r *zip.Reader, phase string) ([]ammoRequest, []ammoAnswer, error) {
+	rc, err := readZipFile(r, "ammo/"+phase+".ammo")
+	if err != nil {
+		return nil, nil, err
+	}
+	requests, err := readAmmo(rc)
+	rc.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rc, err = readZipFile(r, "answers/"+phase+".answ")
+	if err != nil {
+		return nil, nil, err
+	}
+	answers, err := readAnswers(rc)
+	rc.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(requests) != len(answers) {
+		return nil, nil, fmt.Errorf("%s: %d requests but %d answers", phase, len(requests), len(answers))
+	}
+	return requests, answers, nil
+}
+
+// replayClient sends raw ammo requests over a single connection, and
+// reconnects whenever the server closes it.
+type replayClient struct {
+	addr string
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func (c *replayClient) do(raw []byte) (int, []byte, error) {
+	if c.conn == nil {
+		conn, err := net.Dial("tcp", c.addr)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.conn = conn
+		c.br = bufio.NewReader(conn)
+	}
+	if _, err := c.conn.Write(raw); err != nil {
+		c.close()
+		return 0, nil, err
+	}
+	resp, err := http.ReadResponse(c.br, nil)
+	if err != nil {
+		c.close()
+		return 0, nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.Close {
+		c.close()
+	}
+	return resp.StatusCode, body, err
+}
+
+func (c *replayClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// replayResult is the response of the server under test to one request.
+type replayResult struct {
+	status int
+	body   []byte
+}
+
+// replayPhase fires requests at the server at addr over one connection,
+// reconnecting when it is closed, and returns the responses in order.
+func replayPhase(addr string, requests []ammoRequest) ([]replayResult, error) {
+	client := &replayClient{addr: addr}
+	defer client.close()
+	results := make([]replayResult, len(requests))
+	for i, request := range requests {
+		status, body, err := client.do(request.raw)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = replayResult{status: status, body: body}
+	}
+	return results, nil
+}
+
+// replayMain implements "hicup2017 replay": it fires the ammo of
+// test_data.zip at a running server and checks every answer. It works the
+// same against either engine, which makes it the reference for keeping
+// them in agreement.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "address of the server under test")
+	testData := fs.String("test-data", "./test_data.zip", "test_data.zip with ammo and answers")
+	verbose := fs.Int("show", 10, "number of mismatches to print per phase")
+	fs.Parse(args)
+
+	r, err := zip.OpenReader(*testData)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer r.Close()
+
+	failed := false
+	for _, phase := range replayPhases {
+		requests, answers, err := loadPhase(&r.Reader, phase)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		results, err := replayPhase(*addr, requests)
+		if err != nil {
+			log.Println(phase, err)
+			return 1
+		}
+		mismatches := 0
+		for i, result := range results {
+			answer := &answers[i]
+			if answer.matches(result.status, result.body) {
+				continue
+			}
+			mismatches++
+			if mismatches <= *verbose {
+				log.Printf("%s: %s %s: expected %d %s, got %d %s",
+					phase, answer.method, answer.uri, answer.status, answer.body, result.status, bytes.TrimSpace(result.body))
+			}
+		}
+
+		log.Printf("%s: %d requests, %d mismatches", phase, len(requests), mismatches)
+		if mismatches > 0 {
+			failed = true
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
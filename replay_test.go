@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fixtureZip packs the files under dir the way test_data.zip holds them.
+func fixtureZip(t *testing.T, dir string) *zip.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(filepath.ToSlash(name))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// startEngine serves a new test database with the given engine on a local
+// port and returns its address.
+func startEngine(t *testing.T, engine string) (string, func()) {
+	t.Helper()
+	a := newTestAPI(t, newTestDB(t, 10, 10, 30))
+	a.config.Engine = engine
+	// Contest errors have no request ID in their body, which would differ
+	// between the engines.
+	a.config.ContestErrors = true
+	srv, err := newServer(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	return ln.Addr().String(), func() {
+		// Shutdown would also end the change feed the other tests use.
+		if s, ok := srv.(*http.Server); ok {
+			s.Close()
+		}
+		ln.Close()
+	}
+}
+
+// TestReplayEngines fires the ammo in testdata/replay at both engines, each
+// serving the same data, and checks that they give the recorded answers
+// and the same bodies.
+func TestReplayEngines(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	fixture := fixtureZip(t, filepath.Join("testdata", "replay"))
+
+	engines := []string{"http", "raw"}
+	results := make(map[string][][]replayResult)
+	for _, engine := range engines {
+		addr, stop := startEngine(t, engine)
+		for _, phase := range replayPhases {
+			requests, answers, err := loadPhase(fixture, phase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			phaseResults, err := replayPhase(addr, requests)
+			if err != nil {
+				t.Fatalf("%s engine, %s: %v", engine, phase, err)
+			}
+			for i, result := range phaseResults {
+				if answer := &answers[i]; !answer.matches(result.status, result.body) {
+					t.Errorf("%s engine, %s %s: %d %s, want %d %s",
+						engine, answer.method, answer.uri, result.status, bytes.TrimSpace(result.body), answer.status, answer.body)
+				}
+			}
+			results[engine] = append(results[engine], phaseResults)
+		}
+		stop()
+	}
+
+	for p, phase := range replayPhases {
+		requests, _, _ := loadPhase(fixture, phase)
+		for i, want := range results["http"][p] {
+			got := results["raw"][p][i]
+			if got.status != want.status || !bytes.Equal(got.body, want.body) {
+				line := requests[i].raw[:bytes.IndexByte(requests[i].raw, '\r')]
+				t.Errorf("%s: raw engine answered %d %q, http engine %d %q", line, got.status, got.body, want.status, want.body)
+			}
+		}
+	}
+}
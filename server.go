@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// server is what both engines provide to the shutdown logic.
+type server interface {
+	Serve(ln net.Listener) error
+	Shutdown(ctx context.Context) error
+}
+
+// shutdownHooks run once the server has drained, in registration order.
+// Components that keep state outside of InmemoryDB register here to flush
+// it before the process exits.
+var shutdownHooks []func() error
+
+func onShutdown(hook func() error) {
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+func newServer(a *api) (server, error) {
+	switch a.config.Engine {
+	case "http":
+		srv := &http.Server{Handler: a.newRouter()}
+		// Event streams never go idle by themselves.
+		srv.RegisterOnShutdown(func() { changeFeed.close() })
+		return srv, nil
+	case "raw":
+		return newRawServer(a), nil
+	default:
+		return nil, fmt.Errorf("unknown engine %q", a.config.Engine)
+	}
+}
+
+// runServer serves on addr until SIGINT or SIGTERM. It then stops
+// accepting connections, waits up to drainTimeout for requests in flight
+// and runs the shutdown hooks.
+func runServer(srv server, addr string, drainTimeout time.Duration) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+	log.Println("Start running on", addr)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		log.Println("Received", sig, "shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	drainErr := srv.Shutdown(ctx)
+	if drainErr != nil {
+		log.Println("Drain did not finish:", drainErr)
+	}
+
+	for _, hook := range shutdownHooks {
+		if err := hook(); err != nil {
+			log.Println("Shutdown hook failed:", err)
+			if drainErr == nil {
+				drainErr = err
+			}
+		}
+	}
+	return drainErr
+}
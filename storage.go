@@ -0,0 +1,814 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/btree"
+)
+
+// The tables below hold the records of the snapshots. Records are value
+// structs stored in chunks of chunkSize, indexed by ID, so a chunk is a
+// single allocation and most record types are free of pointers the garbage
+// collector would have to follow. IDs outside [0, maxDenseID) go to a
+// B-tree instead, so a stray huge ID does not allocate a huge directory.
+//
+// A table is copied on publish: the copy shares the chunks, and the
+// writer's table copies a chunk before it first modifies it afterwards.
+// Chunks remember the generation of the table that created them for that
+// purpose. Each record type has its own table type, as the shard and
+// snapshot types do.
+//
+// Chunks are small, so a write copies little, and they are found through a
+// chunkDir, so a publish does not copy a directory as large as the table.
+const (
+	chunkBits  = 6
+	chunkSize  = 1 << chunkBits
+	pageBits   = 8
+	pageSize   = 1 << pageBits
+	maxDenseID = 1 << 24
+)
+
+// denseIndex returns the chunk and the offset in it of id, or false if id
+// is kept in the sparse B-tree.
+func denseIndex(id int32) (int, int, bool) {
+	if id < 0 || id >= maxDenseID {
+		return 0, 0, false
+	}
+	return int(id >> chunkBits), int(id & (chunkSize - 1)), true
+}
+
+// chunkPage is a page of a chunkDir.
+type chunkPage struct {
+	gen    uint64
+	chunks [pageSize]interface{}
+}
+
+// chunkDir holds the chunks of a table by number, in pages of pageSize
+// chunks that are copied on write like the chunks themselves. The chunks
+// are *userChunk, *locationChunk, *visitChunk or *postingChunk, depending
+// on the table. gen is the generation of the table.
+type chunkDir struct {
+	gen   uint64
+	pages []*chunkPage
+}
+
+// get returns chunk c, or nil if there is none.
+func (d *chunkDir) get(c int) interface{} {
+	p := c >> pageBits
+	if p >= len(d.pages) || d.pages[p] == nil {
+		return nil
+	}
+	return d.pages[p].chunks[c&(pageSize-1)]
+}
+
+// set stores chunk as chunk c.
+func (d *chunkDir) set(c int, chunk interface{}) {
+	p := c >> pageBits
+	for p >= len(d.pages) {
+		d.pages = append(d.pages, nil)
+	}
+	page := d.pages[p]
+	switch {
+	case page == nil:
+		page = &chunkPage{gen: d.gen}
+	case page.gen != d.gen:
+		copied := *page
+		copied.gen = d.gen
+		page = &copied
+	}
+	d.pages[p] = page
+	page.chunks[c&(pageSize-1)] = chunk
+}
+
+// snapshot returns a copy of d that later writes to d do not change.
+func (d *chunkDir) snapshot() chunkDir {
+	s := chunkDir{gen: d.gen, pages: append([]*chunkPage(nil), d.pages...)}
+	d.gen++
+	return s
+}
+
+// each calls fn with every chunk and its number, in order.
+func (d *chunkDir) each(fn func(c int, chunk interface{})) {
+	for p, page := range d.pages {
+		if page == nil {
+			continue
+		}
+		for i, chunk := range page.chunks {
+			if chunk != nil {
+				fn(p<<pageBits|i, chunk)
+			}
+		}
+	}
+}
+
+// len returns the number of chunks.
+func (d *chunkDir) len() int {
+	n := 0
+	d.each(func(int, interface{}) { n++ })
+	return n
+}
+
+// tableStats describes the memory layout of a table, for the metrics.
+type tableStats struct {
+	records int
+	chunks  int
+	sparse  int
+}
+
+// userRecord is a stored user. Gender is interned in the stringTable.
+type userRecord struct {
+	ok        bool
+	id        int32
+	version   uint32
+	gender    uint32
+	birthDate int64
+	email     string
+	firstName string
+	lastName  string
+}
+
+// Less for btree
+func (a *userRecord) Less(b btree.Item) bool {
+	return a.id < b.(*userRecord).id
+}
+
+type userChunk struct {
+	gen     uint64
+	records [chunkSize]userRecord
+}
+
+type userTable struct {
+	n      int
+	chunks chunkDir
+	sparse *btree.BTree
+}
+
+func newUserTable(degree int) userTable {
+	return userTable{sparse: btree.New(degree)}
+}
+
+func (t *userTable) get(id int32) (userRecord, bool) {
+	if c, o, ok := denseIndex(id); ok {
+		chunk, _ := t.chunks.get(c).(*userChunk)
+		if chunk == nil {
+			return userRecord{}, false
+		}
+		r := chunk.records[o]
+		return r, r.ok
+	}
+	item := t.sparse.Get(&userRecord{id: id})
+	if item == nil {
+		return userRecord{}, false
+	}
+	return *item.(*userRecord), true
+}
+
+func (t *userTable) has(id int32) bool {
+	_, ok := t.get(id)
+	return ok
+}
+
+// put stores r, replacing the record with the same ID.
+func (t *userTable) put(r userRecord) {
+	if !t.has(r.id) {
+		t.n++
+	}
+	r.ok = true
+	if c, o, ok := denseIndex(r.id); ok {
+		t.chunk(c).records[o] = r
+		return
+	}
+	t.sparse.ReplaceOrInsert(&r)
+}
+
+func (t *userTable) delete(id int32) {
+	if !t.has(id) {
+		return
+	}
+	t.n--
+	if c, o, ok := denseIndex(id); ok {
+		t.chunk(c).records[o] = userRecord{}
+		return
+	}
+	t.sparse.Delete(&userRecord{id: id})
+}
+
+// chunk returns chunk c, ready to be modified.
+func (t *userTable) chunk(c int) *userChunk {
+	chunk, _ := t.chunks.get(c).(*userChunk)
+	switch {
+	case chunk == nil:
+		chunk = &userChunk{gen: t.chunks.gen}
+	case chunk.gen == t.chunks.gen:
+		return chunk
+	default:
+		copied := *chunk
+		copied.gen = t.chunks.gen
+		chunk = &copied
+	}
+	t.chunks.set(c, chunk)
+	return chunk
+}
+
+func (t *userTable) stats() tableStats {
+	return tableStats{records: t.n, chunks: t.chunks.len(), sparse: t.sparse.Len()}
+}
+
+// snapshot returns a copy of t that later writes to t do not change.
+func (t *userTable) snapshot() userTable {
+	s := *t
+	s.chunks = t.chunks.snapshot()
+	s.sparse = t.sparse.Clone()
+	return s
+}
+
+// each calls fn with every record, dense ones first.
+func (t *userTable) each(fn func(r *userRecord)) {
+	t.chunks.each(func(_ int, c interface{}) {
+		chunk := c.(*userChunk)
+		for i := range chunk.records {
+			if chunk.records[i].ok {
+				fn(&chunk.records[i])
+			}
+		}
+	})
+	t.sparse.Ascend(func(item btree.Item) bool {
+		fn(item.(*userRecord))
+		return true
+	})
+}
+
+// locationRecord is a stored location. Country and city are interned in
+// the stringTable.
+type locationRecord struct {
+	ok       bool
+	id       int32
+	version  uint32
+	country  uint32
+	city     uint32
+	distance int64
+	place    string
+}
+
+// Less for btree
+func (a *locationRecord) Less(b btree.Item) bool {
+	return a.id < b.(*locationRecord).id
+}
+
+type locationChunk struct {
+	gen     uint64
+	records [chunkSize]locationRecord
+}
+
+// locationTable is the location counterpart of userTable.
+type locationTable struct {
+	n      int
+	chunks chunkDir
+	sparse *btree.BTree
+}
+
+func newLocationTable(degree int) locationTable {
+	return locationTable{sparse: btree.New(degree)}
+}
+
+func (t *locationTable) get(id int32) (locationRecord, bool) {
+	if c, o, ok := denseIndex(id); ok {
+		chunk, _ := t.chunks.get(c).(*locationChunk)
+		if chunk == nil {
+			return locationRecord{}, false
+		}
+		r := chunk.records[o]
+		return r, r.ok
+	}
+	item := t.sparse.Get(&locationRecord{id: id})
+	if item == nil {
+		return locationRecord{}, false
+	}
+	return *item.(*locationRecord), true
+}
+
+func (t *locationTable) has(id int32) bool {
+	_, ok := t.get(id)
+	return ok
+}
+
+func (t *locationTable) put(r locationRecord) {
+	if !t.has(r.id) {
+		t.n++
+	}
+	r.ok = true
+	if c, o, ok := denseIndex(r.id); ok {
+		t.chunk(c).records[o] = r
+		return
+	}
+	t.sparse.ReplaceOrInsert(&r)
+}
+
+func (t *locationTable) delete(id int32) {
+	if !t.has(id) {
+		return
+	}
+	t.n--
+	if c, o, ok := denseIndex(id); ok {
+		t.chunk(c).records[o] = locationRecord{}
+		return
+	}
+	t.sparse.Delete(&locationRecord{id: id})
+}
+
+func (t *locationTable) chunk(c int) *locationChunk {
+	chunk, _ := t.chunks.get(c).(*locationChunk)
+	switch {
+	case chunk == nil:
+		chunk = &locationChunk{gen: t.chunks.gen}
+	case chunk.gen == t.chunks.gen:
+		return chunk
+	default:
+		copied := *chunk
+		copied.gen = t.chunks.gen
+		chunk = &copied
+	}
+	t.chunks.set(c, chunk)
+	return chunk
+}
+
+func (t *locationTable) stats() tableStats {
+	return tableStats{records: t.n, chunks: t.chunks.len(), sparse: t.sparse.Len()}
+}
+
+func (t *locationTable) snapshot() locationTable {
+	s := *t
+	s.chunks = t.chunks.snapshot()
+	s.sparse = t.sparse.Clone()
+	return s
+}
+
+func (t *locationTable) each(fn func(r *locationRecord)) {
+	t.chunks.each(func(_ int, c interface{}) {
+		chunk := c.(*locationChunk)
+		for i := range chunk.records {
+			if chunk.records[i].ok {
+				fn(&chunk.records[i])
+			}
+		}
+	})
+	t.sparse.Ascend(func(item btree.Item) bool {
+		fn(item.(*locationRecord))
+		return true
+	})
+}
+
+// visitRecord is a stored visit. It holds no pointers, so visit chunks are
+// never scanned by the garbage collector.
+type visitRecord struct {
+	ok        bool
+	mark      int8
+	id        int32
+	version   uint32
+	location  int32
+	user      int32
+	visitedAt int64
+}
+
+// Less for btree
+func (a *visitRecord) Less(b btree.Item) bool {
+	return a.id < b.(*visitRecord).id
+}
+
+type visitChunk struct {
+	gen     uint64
+	records [chunkSize]visitRecord
+}
+
+// visitTable is the visit counterpart of userTable.
+type visitTable struct {
+	n      int
+	chunks chunkDir
+	sparse *btree.BTree
+}
+
+func newVisitTable(degree int) visitTable {
+	return visitTable{sparse: btree.New(degree)}
+}
+
+func (t *visitTable) get(id int32) (visitRecord, bool) {
+	if c, o, ok := denseIndex(id); ok {
+		chunk, _ := t.chunks.get(c).(*visitChunk)
+		if chunk == nil {
+			return visitRecord{}, false
+		}
+		r := chunk.records[o]
+		return r, r.ok
+	}
+	item := t.sparse.Get(&visitRecord{id: id})
+	if item == nil {
+		return visitRecord{}, false
+	}
+	return *item.(*visitRecord), true
+}
+
+func (t *visitTable) has(id int32) bool {
+	_, ok := t.get(id)
+	return ok
+}
+
+func (t *visitTable) put(r visitRecord) {
+	if !t.has(r.id) {
+		t.n++
+	}
+	r.ok = true
+	if c, o, ok := denseIndex(r.id); ok {
+		t.chunk(c).records[o] = r
+		return
+	}
+	t.sparse.ReplaceOrInsert(&r)
+}
+
+func (t *visitTable) delete(id int32) {
+	if !t.has(id) {
+		return
+	}
+	t.n--
+	if c, o, ok := denseIndex(id); ok {
+		t.chunk(c).records[o] = visitRecord{}
+		return
+	}
+	t.sparse.Delete(&visitRecord{id: id})
+}
+
+func (t *visitTable) chunk(c int) *visitChunk {
+	chunk, _ := t.chunks.get(c).(*visitChunk)
+	switch {
+	case chunk == nil:
+		chunk = &visitChunk{gen: t.chunks.gen}
+	case chunk.gen == t.chunks.gen:
+		return chunk
+	default:
+		copied := *chunk
+		copied.gen = t.chunks.gen
+		chunk = &copied
+	}
+	t.chunks.set(c, chunk)
+	return chunk
+}
+
+func (t *visitTable) stats() tableStats {
+	return tableStats{records: t.n, chunks: t.chunks.len(), sparse: t.sparse.Len()}
+}
+
+func (t *visitTable) snapshot() visitTable {
+	s := *t
+	s.chunks = t.chunks.snapshot()
+	s.sparse = t.sparse.Clone()
+	return s
+}
+
+func (t *visitTable) each(fn func(r *visitRecord)) {
+	t.chunks.each(func(_ int, c interface{}) {
+		chunk := c.(*visitChunk)
+		for i := range chunk.records {
+			if chunk.records[i].ok {
+				fn(&chunk.records[i])
+			}
+		}
+	})
+	t.sparse.Ascend(func(item btree.Item) bool {
+		fn(item.(*visitRecord))
+		return true
+	})
+}
+
+// postingList is the sorted visit IDs of one user or location kept in the
+// sparse B-tree. used is how many elements of the array behind visits any
+// list has held, see postingSpan.
+type postingList struct {
+	owner  int32
+	visits []int32
+	used   int
+}
+
+// Less for btree
+func (a *postingList) Less(b btree.Item) bool {
+	return a.owner < b.(*postingList).owner
+}
+
+// postingSpan locates the list of an owner in the arena of its chunk: n
+// visits at off, with room for cap. used is how many of the cap elements
+// any list has held. Elements past n that were used may still be read
+// through a published snapshot, while those past used are read by none,
+// so a list may grow into them in place.
+type postingSpan struct {
+	off  uint32
+	n    uint32
+	cap  uint32
+	used uint32
+}
+
+// postingChunk keeps the lists of chunkSize owners in one arena, so a chunk
+// holds a single pointer however many lists it has. Lists never move within
+// an arena and published elements are never overwritten, so copies of a
+// chunk share the arena. An arena that is full is compacted into a new one.
+type postingChunk struct {
+	gen   uint64
+	spans [chunkSize]postingSpan
+	arena []int32
+}
+
+// list returns the visits of the owner at offset o.
+func (c *postingChunk) list(o int) []int32 {
+	s := c.spans[o]
+	return c.arena[s.off : s.off+s.n : s.off+s.n]
+}
+
+// place stores visits as the list of the owner at offset o, in a new span
+// with room for at least capacity visits.
+func (c *postingChunk) place(o int, visits []int32, capacity int) {
+	if len(visits) == 0 {
+		c.spans[o] = postingSpan{}
+		return
+	}
+	if len(c.arena)+capacity > cap(c.arena) {
+		c.compact(capacity)
+	}
+	off := len(c.arena)
+	c.arena = c.arena[:off+capacity]
+	copy(c.arena[off:], visits)
+	c.spans[o] = postingSpan{off: uint32(off), n: uint32(len(visits)), cap: uint32(capacity), used: uint32(len(visits))}
+}
+
+// compact copies the lists into a new arena that has room for extra more
+// elements, dropping the space of replaced lists. The lists keep their
+// room to grow, and the arena gets a quarter more for the lists that
+// outgrow theirs. Readers of the old arena are not affected.
+func (c *postingChunk) compact(extra int) {
+	size := extra
+	for _, s := range c.spans {
+		if s.n > 0 {
+			size += int(s.cap)
+		}
+	}
+	arena := make([]int32, 0, size+size/4)
+	for o, s := range c.spans {
+		if s.n == 0 {
+			continue
+		}
+		off := len(arena)
+		arena = append(arena, c.arena[s.off:s.off+s.n]...)
+		arena = arena[:off+int(s.cap)]
+		c.spans[o] = postingSpan{off: uint32(off), n: s.n, cap: s.cap, used: s.n}
+	}
+	c.arena = arena
+}
+
+// postingCapacity is the room a relocated list of n visits gets, so lists
+// that grow by appends are relocated a logarithmic number of times.
+func postingCapacity(n int) int {
+	if n < 4 {
+		return 4
+	}
+	return 2 * n
+}
+
+// postingTable indexes visits by user or by location. Appending a visit to
+// a list writes past the end of what was published and is done in place;
+// other changes write the list anew. A published list never changes.
+type postingTable struct {
+	n      int
+	chunks chunkDir
+	sparse *btree.BTree
+}
+
+func newPostingTable(degree int) postingTable {
+	return postingTable{sparse: btree.New(degree)}
+}
+
+// get returns the visit IDs of owner in ascending order.
+func (t *postingTable) get(owner int32) []int32 {
+	if c, o, ok := denseIndex(owner); ok {
+		chunk, _ := t.chunks.get(c).(*postingChunk)
+		if chunk == nil {
+			return nil
+		}
+		return chunk.list(o)
+	}
+	item := t.sparse.Get(&postingList{owner: owner})
+	if item == nil {
+		return nil
+	}
+	return item.(*postingList).visits
+}
+
+// add inserts visit into the list of owner.
+func (t *postingTable) add(owner int32, visit int32) {
+	if c, o, ok := denseIndex(owner); ok {
+		chunk := t.chunk(c)
+		old := chunk.list(o)
+		i := searchInt32s(old, visit)
+		if i < len(old) && old[i] == visit {
+			return
+		}
+		t.n++
+		s := &chunk.spans[o]
+		if i == len(old) && s.n == s.used && s.n < s.cap {
+			chunk.arena[s.off+s.n] = visit
+			s.n++
+			s.used++
+			return
+		}
+		chunk.place(o, insertInt32(old, i, visit), postingCapacity(len(old)+1))
+		return
+	}
+
+	var list postingList
+	if item := t.sparse.Get(&postingList{owner: owner}); item != nil {
+		list = *item.(*postingList)
+	}
+	i := searchInt32s(list.visits, visit)
+	if i < len(list.visits) && list.visits[i] == visit {
+		return
+	}
+	t.n++
+	if i == len(list.visits) && len(list.visits) == list.used {
+		// append copies the array when it is full, and writes past what
+		// any list has held otherwise.
+		list.visits = append(list.visits, visit)
+	} else {
+		visits := make([]int32, 0, postingCapacity(len(list.visits)+1))
+		list.visits = append(visits, insertInt32(list.visits, i, visit)...)
+	}
+	list.owner, list.used = owner, len(list.visits)
+	t.sparse.ReplaceOrInsert(&list)
+}
+
+// remove deletes visit from the list of owner.
+func (t *postingTable) remove(owner int32, visit int32) {
+	old := t.get(owner)
+	i := searchInt32s(old, visit)
+	if i == len(old) || old[i] != visit {
+		return
+	}
+	t.n--
+	visits := make([]int32, 0, len(old)-1)
+	visits = append(visits, old[:i]...)
+	visits = append(visits, old[i+1:]...)
+	if c, o, ok := denseIndex(owner); ok {
+		t.chunk(c).place(o, visits, len(visits))
+		return
+	}
+	if len(visits) == 0 {
+		t.sparse.Delete(&postingList{owner: owner})
+		return
+	}
+	t.sparse.ReplaceOrInsert(&postingList{owner: owner, visits: visits, used: len(visits)})
+}
+
+// insertInt32 returns a copy of a with x inserted at index i.
+func insertInt32(a []int32, i int, x int32) []int32 {
+	b := make([]int32, len(a)+1)
+	copy(b, a[:i])
+	b[i] = x
+	copy(b[i+1:], a[i:])
+	return b
+}
+
+func (t *postingTable) chunk(c int) *postingChunk {
+	chunk, _ := t.chunks.get(c).(*postingChunk)
+	switch {
+	case chunk == nil:
+		chunk = &postingChunk{gen: t.chunks.gen}
+	case chunk.gen == t.chunks.gen:
+		return chunk
+	default:
+		copied := *chunk
+		copied.gen = t.chunks.gen
+		chunk = &copied
+	}
+	t.chunks.set(c, chunk)
+	return chunk
+}
+
+func (t *postingTable) stats() tableStats {
+	return tableStats{records: t.n, chunks: t.chunks.len(), sparse: t.sparse.Len()}
+}
+
+func (t *postingTable) snapshot() postingTable {
+	s := *t
+	s.chunks = t.chunks.snapshot()
+	s.sparse = t.sparse.Clone()
+	return s
+}
+
+// each calls fn with every non-empty list.
+func (t *postingTable) each(fn func(owner int32, visits []int32)) {
+	t.chunks.each(func(c int, chunk interface{}) {
+		p := chunk.(*postingChunk)
+		for o := range p.spans {
+			if p.spans[o].n > 0 {
+				fn(int32(c<<chunkBits|o), p.list(o))
+			}
+		}
+	})
+	t.sparse.Ascend(func(item btree.Item) bool {
+		list := item.(*postingList)
+		fn(list.owner, list.visits)
+		return true
+	})
+}
+
+// searchInt32s returns the index of x in the sorted a, or where it would
+// be inserted.
+func searchInt32s(a []int32, x int32) int {
+	lo, hi := 0, len(a)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if a[mid] < x {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// maxWrittenStrings bounds the strings that writes from clients may add to
+// a stringTable, which never shrinks. Loads add as many as the data has.
+const maxWrittenStrings = 1 << 14
+
+// stringTable interns the few distinct values of countries, cities and
+// genders, so records can hold a uint32 instead of a string. Strings are
+// never removed; the table goes away with its InmemoryDB.
+type stringTable struct {
+	mux       sync.Mutex
+	ids       sync.Map     // string -> uint32
+	published atomic.Value // []string
+	// written counts the strings added by reserve.
+	written int
+}
+
+func newStringTable() *stringTable {
+	t := &stringTable{}
+	t.published.Store([]string(nil))
+	return t
+}
+
+// intern returns the ID of s, adding it if needed.
+func (t *stringTable) intern(s string) uint32 {
+	if id, ok := t.ids.Load(s); ok {
+		return id.(uint32)
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if id, ok := t.ids.Load(s); ok {
+		return id.(uint32)
+	}
+	strs := t.published.Load().([]string)
+	id := uint32(len(strs))
+	// Readers only look at the first len(strs) elements of what they
+	// loaded, so appending in place is safe.
+	t.published.Store(append(strs, s))
+	t.ids.Store(s, id)
+	return id
+}
+
+// reserve interns s for a write from a client. It reports false, and
+// leaves the table as it is, if s is new and writes have already added
+// maxWrittenStrings strings.
+func (t *stringTable) reserve(s string) bool {
+	if _, ok := t.ids.Load(s); ok {
+		return true
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if _, ok := t.ids.Load(s); ok {
+		return true
+	}
+	if t.written >= maxWrittenStrings {
+		return false
+	}
+	t.written++
+	strs := t.published.Load().([]string)
+	t.published.Store(append(strs, s))
+	t.ids.Store(s, uint32(len(strs)))
+	return true
+}
+
+// lookup returns the ID of s, or false if s was never interned, in which
+// case no record holds it.
+func (t *stringTable) lookup(s string) (uint32, bool) {
+	id, ok := t.ids.Load(s)
+	if !ok {
+		return 0, false
+	}
+	return id.(uint32), true
+}
+
+func (t *stringTable) get(id uint32) string {
+	return t.published.Load().([]string)[id]
+}
+
+func (t *stringTable) len() int {
+	return len(t.published.Load().([]string))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// Sizes of the benchmark dataset, about a tenth of the contest data.
+const (
+	benchUsers     = 10000
+	benchLocations = 8000
+	benchVisits    = 100000
+)
+
+// gcMeter reports the garbage collections of a benchmark as metrics.
+type gcMeter struct {
+	start runtime.MemStats
+}
+
+// startGCMeter collects garbage and starts counting from there.
+func startGCMeter(b *testing.B) *gcMeter {
+	runtime.GC()
+	m := &gcMeter{}
+	runtime.ReadMemStats(&m.start)
+	b.ResetTimer()
+	return m
+}
+
+// report stops the timer and reports the collections per operation, their
+// pause time and the live heap at the end.
+func (m *gcMeter) report(b *testing.B) {
+	b.StopTimer()
+	var end runtime.MemStats
+	runtime.ReadMemStats(&end)
+	n := float64(b.N)
+	b.ReportMetric(float64(end.NumGC-m.start.NumGC)/n, "gcs/op")
+	b.ReportMetric(float64(end.PauseTotalNs-m.start.PauseTotalNs)/n, "gc-pause-ns/op")
+	b.ReportMetric(float64(end.HeapAlloc), "heap-bytes")
+}
+
+// loadBenchDB loads the benchmark dataset into a new database, the way the
+// data files are loaded.
+func loadBenchDB(users []*User, locations []*Location, visits []*Visit) *InmemoryDB {
+	db := newInmemoryDB(BTreeDegree, defaultAgeReference, 0, defaultConfig().HistoryEntities)
+	db.loadUsers(users, true)
+	db.loadLocations(locations, true)
+	db.loadVisits(visits, true)
+	return db
+}
+
+// BenchmarkLoad loads the benchmark dataset into a new database.
+func BenchmarkLoad(b *testing.B) {
+	users := testUsers(1, benchUsers)
+	locations := testLocations(1, benchLocations)
+	visits := testVisits(1, benchVisits, benchUsers, benchLocations)
+	b.ReportAllocs()
+	m := startGCMeter(b)
+	for i := 0; i < b.N; i++ {
+		loadBenchDB(users, locations, visits)
+	}
+	m.report(b)
+}
+
+// BenchmarkGC measures a full collection while the benchmark dataset is
+// live, which is what every collection costs once the data is loaded.
+func BenchmarkGC(b *testing.B) {
+	db := loadBenchDB(testUsers(1, benchUsers), testLocations(1, benchLocations), testVisits(1, benchVisits, benchUsers, benchLocations))
+	m := startGCMeter(b)
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+	m.report(b)
+	runtime.KeepAlive(db)
+}
+
+// TestPostingTableSnapshots checks that the lists of a published snapshot
+// do not change whatever is written to the table afterwards, including
+// appends into the room left behind a list.
+func TestPostingTableSnapshots(t *testing.T) {
+	for _, owner := range []int32{3, maxDenseID + 3} {
+		table := newPostingTable(BTreeDegree)
+		var snapshots []postingTable
+		var want [][]int32
+		check := func() {
+			t.Helper()
+			for i, s := range snapshots {
+				if got := s.get(owner); !equalInt32s(got, want[i]) {
+					t.Errorf("owner %d, snapshot %d: %v, want %v", owner, i, got, want[i])
+				}
+			}
+		}
+		publish := func() {
+			snapshots = append(snapshots, table.snapshot())
+			want = append(want, append([]int32(nil), table.get(owner)...))
+		}
+
+		for visit := int32(1); visit <= 10; visit++ {
+			table.add(owner, visit*10)
+			table.add(owner+1, visit)
+			publish()
+		}
+		// Removing the last visit leaves room that an older snapshot
+		// still reads, so the next append must not go there.
+		table.remove(owner, 100)
+		publish()
+		table.add(owner, 110)
+		publish()
+		table.add(owner, 5)
+		table.add(owner, 55)
+		table.remove(owner, 10)
+		publish()
+		check()
+
+		final := []int32{5, 20, 30, 40, 50, 55, 60, 70, 80, 90, 110}
+		if got := table.get(owner); !equalInt32s(got, final) {
+			t.Errorf("owner %d: %v, want %v", owner, got, final)
+		}
+		if got := table.get(owner + 1); len(got) != 10 {
+			t.Errorf("owner %d: %v, want 1 to 10", owner+1, got)
+		}
+		if table.n != len(final)+10 {
+			t.Errorf("%d visits indexed, want %d", table.n, len(final)+10)
+		}
+	}
+}
+
+func equalInt32s(a []int32, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// BenchmarkAddVisit adds visits one at a time, each published on its own,
+// to a loaded database. The visits go to a few users and locations, whose
+// lists grow long.
+func BenchmarkAddVisit(b *testing.B) {
+	db := loadBenchDB(testUsers(1, benchUsers), testLocations(1, benchLocations), testVisits(1, benchVisits, benchUsers, benchLocations))
+	visits := testVisits(benchVisits+1, b.N, 10, 10)
+	b.ReportAllocs()
+	m := startGCMeter(b)
+	for _, visit := range visits {
+		db.addVisit(visit)
+	}
+	m.report(b)
+}
+
+func TestStringTableReserve(t *testing.T) {
+	table := newStringTable()
+	table.intern("loaded")
+	for i := 0; i < maxWrittenStrings; i++ {
+		if !table.reserve(fmt.Sprint("written ", i)) {
+			t.Fatalf("string %d refused, want %d taken", i, maxWrittenStrings)
+		}
+	}
+	if table.reserve("one too many") {
+		t.Error("string past the limit taken")
+	}
+	if _, ok := table.lookup("one too many"); ok {
+		t.Error("refused string interned")
+	}
+	// Known strings are always taken, and loads are not limited.
+	if !table.reserve("loaded") || !table.reserve("written 0") {
+		t.Error("known string refused")
+	}
+	table.intern("loaded later")
+	if n := table.len(); n != maxWrittenStrings+2 {
+		t.Errorf("%d strings, want %d", n, maxWrittenStrings+2)
+	}
+}
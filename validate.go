@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of dataset issues, in the order they are reported.
+var datasetIssueKinds = []string{
+	"invalid row",
+	"duplicate id",
+	"unknown user",
+	"unknown location",
+	"mark out of range",
+	"unknown gender",
+	"birth date in the future",
+}
+
+// datasetCheck collects the entities of a dataset and the issues found in
+// it, without building an InmemoryDB.
+type datasetCheck struct {
+	// users, locations and visits map IDs to the file that defined them
+	// first.
+	users     map[int32]string
+	locations map[int32]string
+	visits    map[int32]string
+
+	birthDates map[int32]int64
+	visitRefs  []visitRef
+
+	// now is the generation time of the dataset, from options.txt.
+	now int64
+
+	issues map[string][]string
+}
+
+type visitRef struct {
+	file     string
+	id       int32
+	user     int32
+	location int32
+}
+
+func newDatasetCheck() *datasetCheck {
+	return &datasetCheck{
+		users:      make(map[int32]string),
+		locations:  make(map[int32]string),
+		visits:     make(map[int32]string),
+		birthDates: make(map[int32]int64),
+		issues:     make(map[string][]string),
+	}
+}
+
+func (c *datasetCheck) report(kind string, format string, args ...interface{}) {
+	c.issues[kind] = append(c.issues[kind], fmt.Sprintf(format, args...))
+}
+
+func (c *datasetCheck) define(ids map[int32]string, entity string, file string, id int32) bool {
+	if first, ok := ids[id]; ok {
+		c.report("duplicate id", "%s: %s %d, first defined in %s", file, entity, id, first)
+		return false
+	}
+	ids[id] = file
+	return true
+}
+
+func (c *datasetCheck) addFile(name string, file *dataFile, rowErrs []importRowError) {
+	for _, rowErr := range rowErrs {
+		c.report("invalid row", "%s: line %d: %v", name, rowErr.Line, rowErr.err)
+	}
+	for _, user := range file.Users {
+		if !c.define(c.users, "user", name, user.ID) {
+			continue
+		}
+		if user.Gender != "m" && user.Gender != "f" {
+			c.report("unknown gender", "%s: user %d has gender %q", name, user.ID, user.Gender)
+		}
+		c.birthDates[user.ID] = user.BirthDate
+	}
+	for _, location := range file.Locations {
+		c.define(c.locations, "location", name, location.ID)
+	}
+	for _, visit := range file.Visits {
+		if !c.define(c.visits, "visit", name, visit.ID) {
+			continue
+		}
+		if visit.Mark < 0 || visit.Mark > 5 {
+			c.report("mark out of range", "%s: visit %d has mark %d", name, visit.ID, visit.Mark)
+		}
+		c.visitRefs = append(c.visitRefs, visitRef{name, visit.ID, visit.User, visit.Location})
+	}
+}
+
+// finish runs the checks that need the whole dataset.
+func (c *datasetCheck) finish() {
+	for _, ref := range c.visitRefs {
+		if _, ok := c.users[ref.user]; !ok {
+			c.report("unknown user", "%s: visit %d refers to user %d", ref.file, ref.id, ref.user)
+		}
+		if _, ok := c.locations[ref.location]; !ok {
+			c.report("unknown location", "%s: visit %d refers to location %d", ref.file, ref.id, ref.location)
+		}
+	}
+	if c.now == 0 {
+		return
+	}
+	ids := make([]int, 0, len(c.birthDates))
+	for id, birthDate := range c.birthDates {
+		if birthDate > c.now {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		c.report("birth date in the future", "%s: user %d was born at %d, after %d",
+			c.users[int32(id)], id, c.birthDates[int32(id)], c.now)
+	}
+}
+
+// readOptions returns the timestamp on the first line of options.txt.
+func readOptions(r io.Reader) (int64, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+}
+
+// validateMain checks a dataset the way the server would load it and
+// reports duplicate IDs, dangling visits and out-of-range values. It exits
+// with 1 if it finds any, and 2 if the data cannot be read.
+func validateMain(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	dataPath := fs.String("data", defaultConfig().DataDir, "data to check, as accepted by the server's -data")
+	show := fs.Int("show", 10, "number of issues to print per kind")
+	fs.Parse(args)
+
+	source, err := openDataSource(*dataPath)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	check := newDatasetCheck()
+	// The contest puts options.txt next to data.zip rather than in it.
+	if info, err := os.Stat(*dataPath); err == nil && info.IsDir() {
+		if f, err := os.Open(filepath.Join(*dataPath, "options.txt")); err == nil {
+			check.now, err = readOptions(f)
+			f.Close()
+			if err != nil {
+				log.Println("options.txt:", err)
+				return 2
+			}
+		}
+	}
+
+	err = source.walk(func(name string, r io.Reader) error {
+		if path.Base(name) == "options.txt" {
+			now, err := readOptions(r)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			check.now = now
+			return nil
+		}
+		file, rowErrs, err := decodeDataFile(name, r)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if file != nil {
+			check.addFile(name, file, rowErrs)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	if check.now == 0 {
+		log.Println("WARNING: no options.txt, birth dates are not checked")
+	}
+	check.finish()
+
+	fmt.Printf("%d users, %d locations, %d visits\n", len(check.users), len(check.locations), len(check.visits))
+	total := 0
+	for _, kind := range datasetIssueKinds {
+		issues := check.issues[kind]
+		if len(issues) == 0 {
+			continue
+		}
+		total += len(issues)
+		fmt.Printf("%s: %d\n", kind, len(issues))
+		for i, issue := range issues {
+			if i == *show {
+				fmt.Printf("  ... %d more\n", len(issues)-i)
+				break
+			}
+			fmt.Printf("  %s\n", issue)
+		}
+	}
+	if total > 0 {
+		fmt.Printf("%d issues found\n", total)
+		return 1
+	}
+	fmt.Println("no issues found")
+	return 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"log"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// warmUp prepares a freshly loaded db for traffic: it walks every table,
+// replays the phase 1 ammo of ammoPath against the handlers of rts if set,
+// and collects the garbage of the load, so the first real requests do not
+// pay for any of it. Failures of the replay are logged and do not stop the
+// warm-up.
+func warmUp(db *InmemoryDB, ammoPath string, rts []route) {
+	start := time.Now()
+
+	items := touchDB(db)
+	touched := time.Since(start)
+
+	replayed := 0
+	if ammoPath != "" {
+		var err error
+		replayed, err = replayWarmup(ammoPath, rts)
+		if err != nil {
+			log.Println("WARNING: warm-up replay stopped:", err)
+		}
+	}
+
+	runtime.GC()
+	log.Printf("Warm-up took %v (%d records in %v, %d requests replayed)",
+		time.Since(start), items, touched, replayed)
+}
+
+// touchDB reads every record of every table of db, which brings their
+// chunks into the CPU caches and the page tables. It returns the number of
+// records read.
+func touchDB(db *InmemoryDB) int {
+	userSnap := db.users.load()
+	locationSnap := db.locations.load()
+	visitSnap := db.visits.load()
+	n := 0
+	userSnap.users.each(func(r *userRecord) { n++ })
+	locationSnap.locations.each(func(r *locationRecord) { n++ })
+	visitSnap.visits.each(func(r *visitRecord) { n++ })
+	touchPostings := func(owner int32, visits []int32) {
+		n += len(visits)
+	}
+	visitSnap.visitsByUser.each(touchPostings)
+	visitSnap.visitsByLocation.each(touchPostings)
+	return n
+}
+
+// newWarmupRouter routes GET requests straight to the handlers. It skips
+// the middlewares, so the replay is neither held back by readiness nor
+// counted in the metrics and the access log.
+func newWarmupRouter(rts []route) *mux.Router {
+	r := mux.NewRouter()
+	for _, rt := range rts {
+		if rt.method == "GET" {
+			r.Handle(rt.template, rt.handler).Methods(rt.method)
+		}
+	}
+	return r
+}
+
+// replayWarmup sends the GET requests of phase 1 of a test_data.zip to the
+// handlers in-process and discards the responses. It returns how many
+// requests were sent.
+func replayWarmup(ammoPath string, rts []route) (int, error) {
+	r, err := zip.OpenReader(ammoPath)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	requests, _, err := loadPhase(&r.Reader, replayPhases[0])
+	if err != nil {
+		return 0, err
+	}
+
+	handler := newWarmupRouter(rts)
+	w := &discardResponseWriter{}
+	n := 0
+	for _, request := range requests {
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(request.raw)))
+		if err != nil {
+			return n, err
+		}
+		if req.Method != "GET" {
+			continue
+		}
+		w.header = make(http.Header)
+		handler.ServeHTTP(w, req)
+		n++
+	}
+	return n, nil
+}
+
+// discardResponseWriter is an http.ResponseWriter that drops everything.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {}
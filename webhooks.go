@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// webhookWorkers is the number of deliveries in flight at a time.
+const webhookWorkers = 4
+
+// webhookPayload is the body POSTed to webhooks.
+type webhookPayload struct {
+	EventID uint64 `json:"event_id"`
+	changeEvent
+}
+
+// webhookDelivery is one event on its way to one target.
+type webhookDelivery struct {
+	target   *WebhookTarget
+	event    changeEvent
+	body     []byte
+	attempts int
+	lastErr  error
+}
+
+// webhookDispatcher follows a change feed and POSTs its events to the
+// configured targets. Deliveries are asynchronous and unordered: a failed
+// one waits for its retry while later events go out.
+type webhookDispatcher struct {
+	cfg    WebhooksConfig
+	feed   *eventLog
+	client *http.Client
+	queue  chan *webhookDelivery
+
+	// last is the last event taken from the feed. It belongs to the
+	// follower until it has stopped.
+	last uint64
+
+	mux sync.Mutex
+	// pending counts the deliveries that are queued, being sent or waiting
+	// for a retry. It never exceeds cfg.QueueSize, so queue never blocks.
+	pending int
+	// retrying holds the timers of the deliveries waiting to be retried.
+	retrying map[*webhookDelivery]*time.Timer
+
+	stop      chan struct{}
+	following sync.WaitGroup
+	working   sync.WaitGroup
+	timers    sync.WaitGroup
+
+	deadMux sync.Mutex
+	dead    *os.File
+}
+
+// startWebhooks starts delivering the events of feed if any target is
+// configured. Deliveries that are still pending on shutdown go to the
+// dead-letter file.
+func startWebhooks(feed *eventLog, cfg WebhooksConfig) {
+	if len(cfg.Targets) == 0 {
+		return
+	}
+	d := newWebhookDispatcher(feed, cfg)
+	d.start()
+	onShutdown(d.shutdown)
+	log.Printf("Delivering change events to %d webhooks", len(cfg.Targets))
+}
+
+// newWebhookDispatcher returns a dispatcher for the events published to
+// feed from now on.
+func newWebhookDispatcher(feed *eventLog, cfg WebhooksConfig) *webhookDispatcher {
+	return &webhookDispatcher{
+		cfg:      cfg,
+		feed:     feed,
+		client:   &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		queue:    make(chan *webhookDelivery, cfg.QueueSize),
+		last:     feed.latest(),
+		retrying: make(map[*webhookDelivery]*time.Timer),
+		stop:     make(chan struct{}),
+	}
+}
+
+// start starts following the feed and delivering. shutdown stops it.
+func (d *webhookDispatcher) start() {
+	d.following.Add(1)
+	go d.follow()
+	for i := 0; i < webhookWorkers; i++ {
+		d.working.Add(1)
+		go d.work()
+	}
+}
+
+// follow queues a delivery for each event and each target that wants it.
+func (d *webhookDispatcher) follow() {
+	defer d.following.Done()
+	for {
+		wake, closed := d.take(d.enqueue)
+		if closed {
+			// Requests still draining may write, shutdown picks their
+			// events up.
+			wake = nil
+		}
+		select {
+		case <-wake:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// take passes a delivery for each new event of the feed to queue and
+// returns what feed.since does.
+func (d *webhookDispatcher) take(queue func(*webhookDelivery)) (<-chan struct{}, bool) {
+	events, after, missed, wake, closed := d.feed.since(d.last)
+	if missed {
+		log.Printf("WARNING: webhooks missed the change events after %d, the event buffer is too small", d.last)
+	}
+	d.last = after
+	for _, e := range events {
+		d.last = e.ID
+		for i := range d.cfg.Targets {
+			target := &d.cfg.Targets[i]
+			if !webhookWants(target, e.Entity) {
+				continue
+			}
+			body, err := json.Marshal(webhookPayload{EventID: e.ID, changeEvent: e})
+			if err != nil {
+				log.Println("WARNING: webhook event dropped:", err)
+				continue
+			}
+			queue(&webhookDelivery{target: target, event: e, body: body})
+		}
+	}
+	return wake, closed
+}
+
+func webhookWants(target *WebhookTarget, entity string) bool {
+	if len(target.Entities) == 0 {
+		return true
+	}
+	for _, e := range target.Entities {
+		if e == entity {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue hands a new delivery to the workers, or to the dead-letter file
+// if QueueSize deliveries are pending already. Retries waiting for their
+// turn count as pending, so a failing target cannot grow the backlog past
+// QueueSize.
+func (d *webhookDispatcher) enqueue(delivery *webhookDelivery) {
+	d.mux.Lock()
+	full := d.pending >= d.cfg.QueueSize
+	if !full {
+		d.pending++
+	}
+	d.mux.Unlock()
+	if full {
+		delivery.lastErr = errors.New("queue full")
+		d.deadLetter(delivery)
+		return
+	}
+	d.queue <- delivery
+}
+
+// finish releases the place of a delivery that has been sent or given up.
+func (d *webhookDispatcher) finish() {
+	d.mux.Lock()
+	d.pending--
+	d.mux.Unlock()
+}
+
+func (d *webhookDispatcher) work() {
+	defer d.working.Done()
+	for {
+		select {
+		case delivery := <-d.queue:
+			d.attempt(delivery)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// attempt sends delivery once and schedules its retry if it failed. The
+// retry keeps the delivery's place in the queue.
+func (d *webhookDispatcher) attempt(delivery *webhookDelivery) {
+	delivery.attempts++
+	delivery.lastErr = d.send(delivery)
+	if delivery.lastErr == nil {
+		d.finish()
+		return
+	}
+	if delivery.attempts >= d.cfg.MaxAttempts {
+		d.deadLetter(delivery)
+		d.finish()
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.timers.Add(1)
+	d.retrying[delivery] = time.AfterFunc(d.backoff(delivery.attempts), func() {
+		defer d.timers.Done()
+		d.mux.Lock()
+		delete(d.retrying, delivery)
+		d.mux.Unlock()
+		d.queue <- delivery
+	})
+}
+
+// backoff returns the wait after the given number of failed attempts.
+func (d *webhookDispatcher) backoff(attempts int) time.Duration {
+	backoff := time.Duration(d.cfg.InitialBackoff)
+	for i := 1; i < attempts && backoff < time.Duration(d.cfg.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if backoff > time.Duration(d.cfg.MaxBackoff) {
+		backoff = time.Duration(d.cfg.MaxBackoff)
+	}
+	return backoff
+}
+
+// send POSTs the delivery. Any answer but 2xx is a failure.
+func (d *webhookDispatcher) send(delivery *webhookDelivery) error {
+	req, err := http.NewRequest("POST", delivery.target.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hicup-Event", delivery.event.Type)
+	req.Header.Set("X-Hicup-Event-Id", strconv.FormatUint(delivery.event.ID, 10))
+	if delivery.target.Secret != "" {
+		req.Header.Set("X-Hicup-Signature", "sha256="+webhookSignature(delivery.target.Secret, delivery.body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of body, which receivers
+// compute with the shared secret to authenticate a delivery.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetterLine is a line of the dead-letter file.
+type deadLetterLine struct {
+	Time     string          `json:"time"`
+	URL      string          `json:"url"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// deadLetter appends delivery to the dead-letter file.
+func (d *webhookDispatcher) deadLetter(delivery *webhookDelivery) {
+	line, err := json.Marshal(deadLetterLine{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		URL:      delivery.target.URL,
+		Attempts: delivery.attempts,
+		Error:    delivery.lastErr.Error(),
+		Payload:  delivery.body,
+	})
+	if err == nil {
+		d.deadMux.Lock()
+		if d.dead == nil {
+			d.dead, err = os.OpenFile(d.cfg.DeadLetter, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		}
+		if err == nil {
+			_, err = d.dead.Write(append(line, '\n'))
+		}
+		d.deadMux.Unlock()
+	}
+	if err != nil {
+		log.Printf("WARNING: webhook event %d for %s lost: %v", delivery.event.ID, delivery.target.URL, err)
+		return
+	}
+	log.Printf("WARNING: webhook event %d for %s dead-lettered after %d attempts: %v",
+		delivery.event.ID, delivery.target.URL, delivery.attempts, delivery.lastErr)
+}
+
+// shutdown stops the deliveries. It runs after the server has drained, so
+// no more events come in; the pending ones are written to the dead-letter
+// file.
+func (d *webhookDispatcher) shutdown() error {
+	close(d.stop)
+	d.following.Wait()
+	d.working.Wait()
+
+	// Retries that already fired end up in the queue.
+	d.mux.Lock()
+	for delivery, timer := range d.retrying {
+		if timer.Stop() {
+			d.timers.Done()
+			d.deadLetter(delivery)
+		}
+	}
+	d.mux.Unlock()
+	d.timers.Wait()
+
+	shutdownErr := errors.New("shutdown")
+	for len(d.queue) > 0 {
+		delivery := <-d.queue
+		if delivery.lastErr == nil {
+			delivery.lastErr = shutdownErr
+		}
+		d.deadLetter(delivery)
+	}
+	d.take(func(delivery *webhookDelivery) {
+		delivery.lastErr = shutdownErr
+		d.deadLetter(delivery)
+	})
+
+	d.deadMux.Lock()
+	defer d.deadMux.Unlock()
+	if d.dead == nil {
+		return nil
+	}
+	return d.dead.Close()
+}
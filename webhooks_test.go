@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a test endpoint that answers with the statuses it is
+// given, in order, and 200 once they are used up.
+type webhookReceiver struct {
+	t        *testing.T
+	server   *httptest.Server
+	statuses []int
+
+	mux      sync.Mutex
+	received []receivedDelivery
+	arrived  chan struct{}
+}
+
+type receivedDelivery struct {
+	at     time.Time
+	header http.Header
+	body   []byte
+}
+
+// tempDir returns a new directory and a function that removes it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	rcv := &webhookReceiver{t: t, statuses: statuses, arrived: make(chan struct{}, 100)}
+	rcv.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		rcv.mux.Lock()
+		n := len(rcv.received)
+		rcv.received = append(rcv.received, receivedDelivery{at: time.Now(), header: r.Header, body: body})
+		rcv.mux.Unlock()
+		if n < len(rcv.statuses) {
+			w.WriteHeader(rcv.statuses[n])
+		}
+		rcv.arrived <- struct{}{}
+	}))
+	return rcv
+}
+
+// wait returns the first n deliveries once they have arrived.
+func (rcv *webhookReceiver) wait(n int) []receivedDelivery {
+	for i := 0; i < n; i++ {
+		select {
+		case <-rcv.arrived:
+		case <-time.After(5 * time.Second):
+			rcv.t.Fatalf("got %d deliveries, want %d", i, n)
+		}
+	}
+	rcv.mux.Lock()
+	defer rcv.mux.Unlock()
+	return append([]receivedDelivery(nil), rcv.received[:n]...)
+}
+
+// testWebhooksConfig returns a configuration with fast retries and the
+// dead-letter file in dir.
+func testWebhooksConfig(dir string, targets ...WebhookTarget) WebhooksConfig {
+	cfg := defaultConfig().Webhooks
+	cfg.Targets = targets
+	cfg.InitialBackoff = Duration(20 * time.Millisecond)
+	cfg.MaxBackoff = Duration(80 * time.Millisecond)
+	cfg.DeadLetter = filepath.Join(dir, "dead-letters.ndjson")
+	return cfg
+}
+
+func TestWebhookSignature(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	rcv := newWebhookReceiver(t)
+	defer rcv.server.Close()
+	feed := newEventLog(16)
+	d := newWebhookDispatcher(feed, testWebhooksConfig(dir, WebhookTarget{URL: rcv.server.URL, Secret: "s3cret"}))
+	d.start()
+	defer d.shutdown()
+
+	feed.publish(eventUpdate, "users", 7, 2, User{ID: 7, Email: "a@b.c"})
+	got := rcv.wait(1)[0]
+
+	want := "sha256=" + webhookSignature("s3cret", got.body)
+	if sig := got.header.Get("X-Hicup-Signature"); sig != want {
+		t.Errorf("signature = %q, want %q", sig, want)
+	}
+	if sig := webhookSignature("other", got.body); "sha256="+sig == got.header.Get("X-Hicup-Signature") {
+		t.Error("signature does not depend on the secret")
+	}
+	if typ := got.header.Get("X-Hicup-Event"); typ != eventUpdate {
+		t.Errorf("X-Hicup-Event = %q, want %q", typ, eventUpdate)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(got.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.EventID != 1 || payload.Entity != "users" || payload.Key != 7 || payload.Version != 2 {
+		t.Errorf("payload = %+v", payload)
+	}
+}
+
+func TestWebhookUnsigned(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	rcv := newWebhookReceiver(t)
+	defer rcv.server.Close()
+	feed := newEventLog(16)
+	d := newWebhookDispatcher(feed, testWebhooksConfig(dir, WebhookTarget{URL: rcv.server.URL}))
+	d.start()
+	defer d.shutdown()
+
+	feed.publish(eventCreate, "visits", 1, 1, Visit{ID: 1})
+	if sig := rcv.wait(1)[0].header.Get("X-Hicup-Signature"); sig != "" {
+		t.Errorf("unsigned delivery has signature %q", sig)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	rcv := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	defer rcv.server.Close()
+	feed := newEventLog(16)
+	cfg := testWebhooksConfig(dir, WebhookTarget{URL: rcv.server.URL})
+	d := newWebhookDispatcher(feed, cfg)
+	d.start()
+	defer d.shutdown()
+
+	feed.publish(eventCreate, "locations", 3, 1, Location{ID: 3})
+	got := rcv.wait(3)
+
+	for i := 1; i < len(got); i++ {
+		if string(got[i].body) != string(got[0].body) {
+			t.Errorf("attempt %d sent %s, want %s", i+1, got[i].body, got[0].body)
+		}
+		wait := got[i].at.Sub(got[i-1].at)
+		if backoff := d.backoff(i); wait < backoff {
+			t.Errorf("attempt %d came %v after the previous one, want at least %v", i+1, wait, backoff)
+		}
+	}
+	if _, err := os.Stat(cfg.DeadLetter); !os.IsNotExist(err) {
+		t.Errorf("delivered event was dead-lettered: %v", err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	d := newWebhookDispatcher(newEventLog(1), testWebhooksConfig(dir))
+	want := []time.Duration{20, 40, 80, 80}
+	for i, w := range want {
+		if got := d.backoff(i + 1); got != w*time.Millisecond {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w*time.Millisecond)
+		}
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	rcv := newWebhookReceiver(t, 500, 500, 500, 500, 500)
+	defer rcv.server.Close()
+	feed := newEventLog(16)
+	cfg := testWebhooksConfig(dir, WebhookTarget{URL: rcv.server.URL})
+	cfg.MaxAttempts = 2
+	d := newWebhookDispatcher(feed, cfg)
+	d.start()
+
+	feed.publish(eventDelete, "users", 9, 4, nil)
+	rcv.wait(2)
+	// shutdown waits for the worker, which dead-letters the event after the
+	// second failure.
+	if err := d.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readDeadLetters(t, cfg.DeadLetter)
+	if len(lines) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(lines))
+	}
+	line := lines[0]
+	if line.URL != rcv.server.URL || line.Attempts != 2 || line.Error != "status 500" {
+		t.Errorf("dead letter = %+v", line)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(line.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Type != eventDelete || payload.Key != 9 {
+		t.Errorf("dead-lettered payload = %+v", payload)
+	}
+}
+
+// readDeadLetters returns the lines of the dead-letter file at path.
+func readDeadLetters(t *testing.T, path string) []deadLetterLine {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []deadLetterLine
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line deadLetterLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// TestWebhookQueueBound fails the deliveries of two events against a queue
+// of two, with a backoff long enough that their retries stay parked. The
+// events that come after must be dead-lettered instead of piling up.
+func TestWebhookQueueBound(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	rcv := newWebhookReceiver(t, 500, 500, 500, 500, 500)
+	defer rcv.server.Close()
+	feed := newEventLog(16)
+	cfg := testWebhooksConfig(dir, WebhookTarget{URL: rcv.server.URL})
+	cfg.QueueSize = 2
+	cfg.InitialBackoff = Duration(time.Hour)
+	cfg.MaxBackoff = cfg.InitialBackoff
+	d := newWebhookDispatcher(feed, cfg)
+	// The test takes the events from the feed itself, so it knows when
+	// they are queued.
+	for i := 0; i < webhookWorkers; i++ {
+		d.working.Add(1)
+		go d.work()
+	}
+	publish := func(first int32, n int32) {
+		for id := first; id < first+n; id++ {
+			feed.publish(eventCreate, "users", id, 1, User{ID: id})
+		}
+		d.take(d.enqueue)
+	}
+
+	publish(1, 2)
+	rcv.wait(2)
+	publish(3, 3)
+	if err := d.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	rcv.mux.Lock()
+	if n := len(rcv.received); n != 2 {
+		t.Errorf("receiver got %d deliveries, want 2", n)
+	}
+	rcv.mux.Unlock()
+
+	var full, parked int
+	for _, line := range readDeadLetters(t, cfg.DeadLetter) {
+		switch {
+		case line.Error == "queue full" && line.Attempts == 0:
+			full++
+		case line.Error == "status 500" && line.Attempts == 1:
+			parked++
+		default:
+			t.Errorf("unexpected dead letter %+v", line)
+		}
+	}
+	if full != 3 || parked != 2 {
+		t.Errorf("dead-lettered %d events for a full queue and %d parked retries, want 3 and 2", full, parked)
+	}
+}
+
+func TestWebhookEntityFilter(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	rcv := newWebhookReceiver(t)
+	defer rcv.server.Close()
+	feed := newEventLog(16)
+	d := newWebhookDispatcher(feed, testWebhooksConfig(dir, WebhookTarget{URL: rcv.server.URL, Entities: []string{"visits"}}))
+	d.start()
+	defer d.shutdown()
+
+	feed.publish(eventCreate, "users", 1, 1, User{ID: 1})
+	feed.publish(eventCreate, "visits", 2, 1, Visit{ID: 2})
+	var payload webhookPayload
+	if err := json.Unmarshal(rcv.wait(1)[0].body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Entity != "visits" {
+		t.Errorf("delivered %s event to a visits-only target", payload.Entity)
+	}
+}